@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/dbendit/traefik-forward-auth-plex-sso/internal/fakeplex"
+)
+
+// Main
+func main() {
+	listen := flag.String("listen", "127.0.0.1:32401", "Address to listen on")
+	fixture := flag.String("fixture", "", "Path to a yaml or json file of users (required)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  fakeplex -fixture <path> [-listen <address>]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if len(*fixture) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := fakeplex.LoadFixture(*fixture)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Fake Plex listening on %s with %d users", *listen, len(f.Users))
+	log.Printf("Run traefik-forward-auth with --plex-url=http://%s --plex-login-url=http://%s/auth/#!", *listen, *listen)
+
+	s := fakeplex.New(f)
+	err = http.ListenAndServe(*listen, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+		s.ServeHTTP(w, r)
+	}))
+	log.Fatal(err)
+}
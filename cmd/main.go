@@ -3,23 +3,83 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	internal "github.com/dbendit/traefik-forward-auth-plex-sso/internal"
 )
 
 // Main
 func main() {
-	// Parse options
-	config := internal.NewGlobalConfig()
+	// Check for the "validate" command, which only checks the config, or the
+	// "explain" command, which evaluates requests against the rules
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && (args[0] == "validate" || args[0] == "explain") {
+		command = args[0]
+		args = args[1:]
+	}
+
+	var explain *internal.ExplainOptions
+	if command == "explain" {
+		var err error
+		explain, err = internal.ParseExplainArgs(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		args = explain.Extra
+	}
+
+	// Parse options, commands that only check the config don't create state
+	var config *internal.Config
+	if len(command) > 0 {
+		config = internal.NewGlobalConfigReadOnly(args)
+	} else {
+		config = internal.NewGlobalConfig(args)
+	}
 
 	// Setup logger
 	log := internal.NewDefaultLogger()
 
 	// Perform config validation
 	config.Validate()
+	switch command {
+	case "validate":
+		if len(config.RuleFileErrors()) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	case "explain":
+		ok, err := internal.Explain(explain, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Build server
 	server := internal.NewServer()
+	defer server.Close()
+
+	// Reload config on SIGHUP, and when config or rule files change
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Info("Received SIGHUP, reloading config")
+			server.Reload(args)
+		}
+	}()
+	if config.WatchConfig || len(config.RulesDir) > 0 {
+		go server.WatchConfig(args)
+	}
 
 	// Attach router to default server
 	http.HandleFunc("/", server.RootHandler)
@@ -0,0 +1,147 @@
+package tfaps
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prefix of the hash of an API key, as set by "api-key.<name>.hash"
+const apiKeyHashPrefix = "sha256:"
+
+// APIKey holds a named API key that machine clients can use in place of a
+// Plex login
+type APIKey struct {
+	Hash     []byte
+	Identity string
+	Rules    CommaSeparatedList
+	Tier     AccessTier
+	Expires  time.Time
+}
+
+// NewAPIKey creates a new API key object, with an identity derived from the
+// key name
+func NewAPIKey(name string) *APIKey {
+	return &APIKey{
+		Identity: name + "@api-key",
+	}
+}
+
+// Validate validates an API key
+func (k *APIKey) Validate(name string) error {
+	if len(k.Hash) == 0 {
+		return fmt.Errorf("api key \"%s\" must have a \"hash\"", name)
+	}
+	if len(k.Rules) == 0 {
+		return fmt.Errorf("api key \"%s\" must be scoped to at least one rule with \"rules\"", name)
+	}
+
+	return nil
+}
+
+// Allows returns true if the key may be used for the given rule
+func (k *APIKey) Allows(rule string) bool {
+	for _, r := range k.Rules {
+		if r == rule {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Expired returns true if the key has an expiry that has passed
+func (k *APIKey) Expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// Claims returns the synthetic identity of the key, so it can be authorized
+// the same way as a user
+func (k *APIKey) Claims(cfg *Config) Claims {
+	return NewClaims(cfg, User{Email: k.Identity}, k.Tier)
+}
+
+// HashAPIKey returns the hash of an API key in the format expected by the
+// "api-key.<name>.hash" option
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+func parseAPIKeyHash(value string) ([]byte, error) {
+	if !strings.HasPrefix(value, apiKeyHashPrefix) {
+		return nil, errors.New("invalid api key hash, must be in the format \"sha256:<hex>\"")
+	}
+
+	hash, err := hex.DecodeString(strings.TrimPrefix(value, apiKeyHashPrefix))
+	if err != nil || len(hash) != sha256.Size {
+		return nil, errors.New("invalid api key hash, must be in the format \"sha256:<hex>\"")
+	}
+
+	return hash, nil
+}
+
+func parseAPIKeyExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	// A date alone expires at the end of that day
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid api key expiry \"%s\", must be a date (2006-01-02) or time (2006-01-02T15:04:05Z07:00)", value)
+	}
+
+	return t.Add(24 * time.Hour), nil
+}
+
+// FindAPIKey returns the name and details of the configured API key matching
+// the key given, or false if there is no match
+func FindAPIKey(cfg *Config, key string) (string, *APIKey, bool) {
+	sum := sha256.Sum256([]byte(key))
+
+	// Compare against every key so the time taken doesn't reveal a match
+	var name string
+	apiKeys := cfg.APIKeys
+	names := make([]string, 0, len(apiKeys))
+	for n := range apiKeys {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if subtle.ConstantTimeCompare(sum[:], apiKeys[n].Hash) == 1 {
+			name = n
+		}
+	}
+
+	if len(name) == 0 {
+		return "", nil, false
+	}
+
+	return name, apiKeys[name], true
+}
+
+// Get the API key passed by a machine client, if any, from the configured
+// header or as a bearer token. Bearer tokens may belong to the upstream app
+// rather than be an API key, so whether the key came from the configured
+// header is also returned.
+func requestAPIKey(cfg *Config, r *http.Request) (string, bool) {
+	if header := cfg.APIKeyHeader; len(header) > 0 {
+		if key := r.Header.Get(header); len(key) > 0 {
+			return key, true
+		}
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:]), false
+	}
+
+	return "", false
+}
@@ -0,0 +1,136 @@
+package tfaps
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestAPIKeyRequestAPIKey(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{})
+
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	key, fromHeader := requestAPIKey(config, r)
+	assert.Equal("", key)
+	assert.False(fromHeader)
+
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	key, _ = requestAPIKey(config, r)
+	assert.Equal("", key, "should ignore other authorization schemes")
+
+	r.Header.Set("Authorization", "Bearer bearerkey")
+	key, fromHeader = requestAPIKey(config, r)
+	assert.Equal("bearerkey", key)
+	assert.False(fromHeader)
+
+	r.Header.Set("X-Api-Key", "headerkey")
+	key, fromHeader = requestAPIKey(config, r)
+	assert.Equal("bearerkey", key, "should ignore header unless configured")
+	assert.False(fromHeader)
+
+	setTestConfig([]string{"--api-key-header=X-Api-Key"})
+	key, fromHeader = requestAPIKey(config, r)
+	assert.Equal("headerkey", key, "configured header should take precedence")
+	assert.True(fromHeader)
+}
+
+func TestAPIKeyFindAPIKey(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{
+		"--api-key.ci.hash=" + HashAPIKey("one"),
+		"--api-key.monitor.hash=" + HashAPIKey("two"),
+	})
+
+	name, key, ok := FindAPIKey(config, "two")
+	assert.True(ok)
+	assert.Equal("monitor", name)
+	assert.Equal("monitor@api-key", key.Identity)
+
+	_, _, ok = FindAPIKey(config, "three")
+	assert.False(ok)
+}
+
+func TestAPIKeyAuthHandler(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{
+		"--whitelist=test@test.com",
+		"--rule.ci.rule=PathPrefix(`/ci`)",
+		"--rule.ci.whitelist=ci@api-key",
+		"--rule.admin.rule=PathPrefix(`/admin`)",
+		"--rule.admin.tier=owner",
+		"--rule.admin.domains=api-key",
+		"--api-key.ci.hash=" + HashAPIKey("cikey"),
+		"--api-key.ci.rules=ci,admin,default",
+		"--api-key.old.hash=" + HashAPIKey("oldkey"),
+		"--api-key.old.rules=ci",
+		"--api-key.old.identity=ci@api-key",
+		"--api-key.old.expires=" + time.Now().Add(-time.Hour).Format(time.RFC3339),
+		"--api-key-header=X-Api-Key",
+	})
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	request := func(uri, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Method", "GET")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w
+	}
+
+	// Should allow key whitelisted by rule
+	w := request("/ci/build", "cikey")
+	assert.Equal(200, w.Code)
+	assert.Equal("ci@api-key", w.Header().Get("X-Forwarded-User"))
+
+	// Should not allow unknown key
+	w = request("/ci/build", "badkey")
+	assert.Equal(401, w.Code)
+
+	// Should pass unknown bearer tokens through to cookie auth
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.Header.Set("X-Forwarded-Method", "GET")
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/other")
+	r.Header.Set("Authorization", "Bearer grafanatoken")
+	r.AddCookie(mustMakeCookie(t, r, NewClaims(config, User{Email: "test@test.com"}, NoAccess)))
+	w = httptest.NewRecorder()
+	s.RootHandler(w, r)
+	assert.Equal(200, w.Code, "valid cookie should be allowed with another app's bearer token")
+	assert.Equal("test@test.com", w.Header().Get("X-Forwarded-User"))
+
+	// Should not pass unknown keys in the configured header through
+	r.Header.Set("X-Api-Key", "badkey")
+	w = httptest.NewRecorder()
+	s.RootHandler(w, r)
+	assert.Equal(401, w.Code)
+
+	// Should not allow expired key
+	w = request("/ci/build", "oldkey")
+	assert.Equal(401, w.Code)
+
+	// Should apply global whitelist to default rule
+	w = request("/other", "cikey")
+	assert.Equal(401, w.Code)
+
+	// Should apply rule tier
+	w = request("/admin", "cikey")
+	assert.Equal(401, w.Code)
+
+	// Should not allow key on rules it isn't scoped to
+	config.APIKeys["ci"].Rules = CommaSeparatedList{"admin"}
+	w = request("/ci/build", "cikey")
+	assert.Equal(401, w.Code)
+}
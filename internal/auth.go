@@ -1,12 +1,19 @@
 package tfaps
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -14,54 +21,226 @@ import (
 
 // Request Validation
 
-// ValidateCookie verifies that a cookie matches the expected format of:
+// Claims holds the identity of an authenticated user, as carried in the auth
+// cookie
+type Claims struct {
+	UserID     int64      `json:"uid,omitempty"`
+	UUID       string     `json:"uui,omitempty"`
+	Username   string     `json:"usr,omitempty"`
+	Title      string     `json:"ttl,omitempty"`
+	Email      string     `json:"eml"`
+	Thumb      string     `json:"thm,omitempty"`
+	Home       bool       `json:"hom,omitempty"`
+	Managed    bool       `json:"mgd,omitempty"`
+	Subscribed bool       `json:"sub,omitempty"`
+	Plan       string     `json:"pln,omitempty"`
+	Tier       AccessTier `json:"tie"`
+	IssuedAt   int64      `json:"iat"`
+	Expires    int64      `json:"exp"`
+	CheckedAt  int64      `json:"chk,omitempty"`
+	Token      string     `json:"tok,omitempty"`
+}
+
+// NewClaims creates claims for a user, valid for the configured lifetime
+func NewClaims(cfg *Config, user User, tier AccessTier) Claims {
+	now := time.Now().Unix()
+	return Claims{
+		UserID:     user.Id,
+		UUID:       user.UUID,
+		Username:   user.Username,
+		Title:      user.Title,
+		Email:      user.Email,
+		Thumb:      user.Thumb,
+		Home:       user.Home,
+		Managed:    user.Restricted,
+		Subscribed: user.Subscription.Active,
+		Plan:       user.Subscription.Plan,
+		Tier:       tier,
+		IssuedAt:   now,
+		Expires:    cookieExpiry(cfg).Unix(),
+		CheckedAt:  now,
+	}
+}
+
+// SealToken encrypts a Plex token so it can be stored with a session
+func SealToken(cfg *Config, token string) (string, error) {
+	aead, err := newCipher(cfg, tokenKeyInfo)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(token)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(token), nil)), nil
+}
+
+// OpenToken decrypts a Plex token sealed by SealToken
+func OpenToken(cfg *Config, sealed string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", errors.New("unable to decode token")
+	}
+
+	aead, err := newCipher(cfg, tokenKeyInfo)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("invalid token format")
+	}
+
+	token, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt token")
+	}
+
+	return string(token), nil
+}
+
+// Current cookie format version prefix
+const cookieV2Prefix = "v2."
+
+// ValidateCookie verifies that a cookie is a valid, unexpired auth cookie and
+// returns the claims it holds. The current format is:
+// Cookie = v2.base64(nonce|encrypt(secret, cookie domain, claims))
+//
+// Cookies in the legacy v1 format are still accepted until they expire, and
+// have no access tier:
 // Cookie = hash(secret, cookie domain, email, expires)|expires|email
-func ValidateCookie(r *http.Request, c *http.Cookie) (string, error) {
-	parts := strings.Split(c.Value, "|")
+func ValidateCookie(cfg *Config, r *http.Request, c *http.Cookie) (Claims, error) {
+	var claims Claims
+	var err error
+	if strings.HasPrefix(c.Value, cookieV2Prefix) {
+		claims, err = decodeCookieV2(cfg, r, c.Value[len(cookieV2Prefix):])
+	} else {
+		claims, err = decodeCookieV1(cfg, r, c.Value)
+	}
+	if err != nil {
+		return Claims{}, err
+	}
+
+	// Has it expired?
+	if time.Unix(claims.Expires, 0).Before(time.Now()) {
+		return Claims{}, errors.New("Cookie has expired")
+	}
+
+	// Looks valid
+	return claims, nil
+}
+
+func decodeCookieV2(cfg *Config, r *http.Request, value string) (Claims, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return Claims{}, errors.New("Unable to decode cookie")
+	}
+
+	aead, err := newCipher(cfg, cookieKeyInfo)
+	if err != nil {
+		return Claims{}, errors.New("Unable to create cookie cipher")
+	}
+
+	if len(data) < aead.NonceSize() {
+		return Claims{}, errors.New("Invalid cookie format")
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(cookieDomain(cfg, r)))
+	if err != nil {
+		return Claims{}, errors.New("Unable to decrypt cookie")
+	}
+
+	var claims Claims
+	err = json.Unmarshal(plaintext, &claims)
+	if err != nil {
+		return Claims{}, errors.New("Unable to parse cookie claims")
+	}
+
+	return claims, nil
+}
+
+func decodeCookieV1(cfg *Config, r *http.Request, value string) (Claims, error) {
+	parts := strings.Split(value, "|")
 
 	if len(parts) != 3 {
-		return "", errors.New("Invalid cookie format")
+		return Claims{}, errors.New("Invalid cookie format")
 	}
+	expiry, email := parts[1], parts[2]
 
 	mac, err := base64.URLEncoding.DecodeString(parts[0])
 	if err != nil {
-		return "", errors.New("Unable to decode cookie mac")
+		return Claims{}, errors.New("Unable to decode cookie mac")
 	}
 
-	expectedSignature := cookieSignature(r, parts[2], parts[1])
+	expectedSignature := cookieSignature(cfg, r, email, expiry)
 	expected, err := base64.URLEncoding.DecodeString(expectedSignature)
 	if err != nil {
-		return "", errors.New("Unable to generate mac")
+		return Claims{}, errors.New("Unable to generate mac")
 	}
 
 	// Valid token?
 	if !hmac.Equal(mac, expected) {
-		return "", errors.New("Invalid cookie mac")
+		return Claims{}, errors.New("Invalid cookie mac")
+	}
+
+	// The mac doesn't delimit the email and expiry, so only accept splits where
+	// they can't be moved between the two
+	if !isDigits(expiry) || (len(email) > 0 && isDigits(email[len(email)-1:])) {
+		return Claims{}, errors.New("Invalid cookie format")
 	}
 
-	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	expires, err := strconv.ParseInt(expiry, 10, 64)
 	if err != nil {
-		return "", errors.New("Unable to parse cookie expiry")
+		return Claims{}, errors.New("Unable to parse cookie expiry")
+	}
+
+	return Claims{Email: email, Expires: expires}, nil
+}
+
+// Whether a string is non-empty and only holds the digits 0-9
+func isDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateSessionCookie verifies that a cookie holds the id of an unexpired
+// session in the given store and returns the claims for that session
+func ValidateSessionCookie(store SessionStore, c *http.Cookie) (Claims, error) {
+	claims, err := store.Get(SessionKey(c.Value))
+	if errors.Is(err, ErrSessionNotFound) {
+		return Claims{}, errors.New("Session not found")
+	} else if err != nil {
+		return Claims{}, err
 	}
 
 	// Has it expired?
-	if time.Unix(expires, 0).Before(time.Now()) {
-		return "", errors.New("Cookie has expired")
+	if time.Unix(claims.Expires, 0).Before(time.Now()) {
+		return Claims{}, errors.New("Cookie has expired")
 	}
 
-	// Looks valid
-	return parts[2], nil
+	return claims, nil
 }
 
 // ValidateEmail checks if the given email address matches either a whitelisted
 // email address, as defined by the "whitelist" config parameter. Or is part of
 // a permitted domain, as defined by the "domains" config parameter
-func ValidateEmail(email, ruleName string) bool {
+func ValidateEmail(cfg *Config, email, ruleName string) bool {
 	// Use global config by default
-	whitelist := config.Whitelist
-	domains := config.Domains
+	whitelist := cfg.Whitelist
+	domains := cfg.Domains
 
-	if rule, ok := config.Rules[ruleName]; ok {
+	if rule, ok := cfg.Rules[ruleName]; ok {
 		// Override with rule config if found
 		if len(rule.Whitelist) > 0 || len(rule.Domains) > 0 {
 			whitelist = rule.Whitelist
@@ -81,7 +260,7 @@ func ValidateEmail(email, ruleName string) bool {
 		}
 
 		// If we're not matching *either*, stop here
-		if !config.MatchWhitelistOrDomain {
+		if !cfg.MatchWhitelistOrDomain {
 			return false
 		}
 	}
@@ -94,6 +273,22 @@ func ValidateEmail(email, ruleName string) bool {
 	return false
 }
 
+// ValidateAccessTier checks if the given access tier meets the minimum tier
+// required by the rule, as defined by the "tier" rule parameter. Or by the
+// "min-tier" config parameter if the rule doesn't set one
+func ValidateAccessTier(cfg *Config, tier AccessTier, ruleName string) bool {
+	return tier >= requiredAccessTier(cfg, ruleName)
+}
+
+// Get the minimum access tier for a rule
+func requiredAccessTier(cfg *Config, ruleName string) AccessTier {
+	if rule, ok := cfg.Rules[ruleName]; ok && rule.Tier != NoAccess {
+		return rule.Tier
+	}
+
+	return cfg.MinTier
+}
+
 // ValidateWhitelist checks if the email is in whitelist
 func ValidateWhitelist(email string, whitelist CommaSeparatedList) bool {
 	for _, whitelist := range whitelist {
@@ -125,32 +320,63 @@ func redirectBase(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", r.Header.Get("X-Forwarded-Proto"), r.Host)
 }
 
-// Return url
+// Return url, including any prefix stripped before the request was forwarded
 func returnUrl(r *http.Request) string {
-	return fmt.Sprintf("%s%s", redirectBase(r), r.URL.Path)
+	return fmt.Sprintf("%s%s%s", redirectBase(r), forwardedPrefix(r), r.URL.RequestURI())
+}
+
+// Maximum length of a return url stored in the csrf cookie, leaving room for
+// the rest of the cookie within the 4KB browser limit once encoded
+const maxReturnUrlLength = 2048
+
+// Get the url to return to following login, falling back to shorter forms
+// if the full url won't fit in the csrf cookie
+func loginReturnUrl(r *http.Request) string {
+	candidates := []string{
+		returnUrl(r),
+		fmt.Sprintf("%s%s%s", redirectBase(r), forwardedPrefix(r), r.URL.EscapedPath()),
+		fmt.Sprintf("%s%s/", redirectBase(r), forwardedPrefix(r)),
+	}
+	for _, candidate := range candidates {
+		if len(candidate) <= maxReturnUrlLength {
+			return candidate
+		}
+	}
+
+	return redirectBase(r)
+}
+
+// Get the normalised X-Forwarded-Prefix header
+func forwardedPrefix(r *http.Request) string {
+	prefix := strings.Trim(r.Header.Get("X-Forwarded-Prefix"), "/")
+	if len(prefix) == 0 {
+		return ""
+	}
+
+	return "/" + (&url.URL{Path: prefix}).EscapedPath()
 }
 
 // Get oauth redirect uri
-func redirectUri(r *http.Request) string {
-	if use, _ := useAuthDomain(r); use {
+func redirectUri(cfg *Config, r *http.Request) string {
+	if use, _ := useAuthDomain(cfg, r); use {
 		p := r.Header.Get("X-Forwarded-Proto")
-		return fmt.Sprintf("%s://%s%s", p, config.AuthHost, config.Path)
+		return fmt.Sprintf("%s://%s%s", p, cfg.AuthHost, cfg.Path)
 	}
 
-	return fmt.Sprintf("%s%s", redirectBase(r), config.Path)
+	return fmt.Sprintf("%s%s", redirectBase(r), cfg.Path)
 }
 
 // Should we use auth host + what it is
-func useAuthDomain(r *http.Request) (bool, string) {
-	if config.AuthHost == "" {
+func useAuthDomain(cfg *Config, r *http.Request) (bool, string) {
+	if cfg.AuthHost == "" {
 		return false, ""
 	}
 
 	// Does the request match a given cookie domain?
-	reqMatch, reqHost := matchCookieDomains(r.Host)
+	reqMatch, reqHost := matchCookieDomains(cfg, r.Host)
 
 	// Do any of the auth hosts match a cookie domain?
-	authMatch, authHost := matchCookieDomains(config.AuthHost)
+	authMatch, authHost := matchCookieDomains(cfg, cfg.AuthHost)
 
 	// We need both to match the same domain
 	return reqMatch && authMatch && reqHost == authHost, reqHost
@@ -158,94 +384,206 @@ func useAuthDomain(r *http.Request) (bool, string) {
 
 // Cookie methods
 
-// MakeCookie creates an auth cookie
-func MakeCookie(r *http.Request, email string) *http.Cookie {
-	expires := cookieExpiry()
-	mac := cookieSignature(r, email, fmt.Sprintf("%d", expires.Unix()))
-	value := fmt.Sprintf("%s|%d|%s", mac, expires.Unix(), email)
+// MakeCookie creates an auth cookie holding the given claims, encrypted so
+// that only this service can read or modify them
+func MakeCookie(cfg *Config, r *http.Request, claims Claims) (*http.Cookie, error) {
+	value, err := encodeCookieV2(cfg, r, claims)
+	if err != nil {
+		return nil, err
+	}
 
 	return &http.Cookie{
-		Name:     config.CookieName,
+		Name:     cfg.CookieName,
 		Value:    value,
 		Path:     "/",
-		Domain:   cookieDomain(r),
+		Domain:   cookieDomain(cfg, r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
-		Expires:  expires,
+		Secure:   !cfg.InsecureCookie,
+		Expires:  time.Unix(claims.Expires, 0).Local(),
+	}, nil
+}
+
+func encodeCookieV2(cfg *Config, r *http.Request, claims Claims) (string, error) {
+	plaintext, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("encoding cookie claims: %w", err)
+	}
+
+	aead, err := newCipher(cfg, cookieKeyInfo)
+	if err != nil {
+		return "", fmt.Errorf("creating cookie cipher: %w", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating cookie nonce: %w", err)
+	}
+
+	data := aead.Seal(nonce, nonce, plaintext, []byte(cookieDomain(cfg, r)))
+	return cookieV2Prefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// MakeSessionCookie creates an auth cookie holding only an opaque session id,
+// the claims for which are held in the session store
+func MakeSessionCookie(cfg *Config, r *http.Request, id string, claims Claims) *http.Cookie {
+	return &http.Cookie{
+		Name:     cfg.CookieName,
+		Value:    id,
+		Path:     "/",
+		Domain:   cookieDomain(cfg, r),
+		HttpOnly: true,
+		Secure:   !cfg.InsecureCookie,
+		Expires:  time.Unix(claims.Expires, 0).Local(),
 	}
 }
 
 // ClearCookie clears the auth cookie
-func ClearCookie(r *http.Request) *http.Cookie {
+func ClearCookie(cfg *Config, r *http.Request) *http.Cookie {
 	return &http.Cookie{
-		Name:     config.CookieName,
+		Name:     cfg.CookieName,
 		Value:    "",
 		Path:     "/",
-		Domain:   cookieDomain(r),
+		Domain:   cookieDomain(cfg, r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !cfg.InsecureCookie,
 		Expires:  time.Now().Local().Add(time.Hour * -1),
 	}
 }
 
 // MakeCSRFCookie makes a csrf cookie (used during login only)
 //
+// The cookie is signed and bound to the nonce that is passed to Plex in the
+// state parameter of the forward url, in the format of:
+// Cookie = hash(secret, nonce, pin id, redirect):nonce:pinId:base64(redirect)
+//
 // Note, CSRF cookies live shorter than auth cookies, a fixed 1h.
 // That's because some CSRF cookies may belong to auth flows that don't complete
 // and thus may not get cleared by ClearCookie.
-func MakeCSRFCookie(r *http.Request, pinId string, redirectUri string) *http.Cookie {
+func MakeCSRFCookie(cfg *Config, r *http.Request, nonce string, pinId string, redirect string) *http.Cookie {
+	mac := csrfSignature(cfg, nonce, pinId, redirect)
 	return &http.Cookie{
-		Name:     config.CSRFCookieName,
-		Value:    fmt.Sprintf("%s:%s", pinId, redirectUri),
+		Name:     cfg.CSRFCookieName,
+		Value:    fmt.Sprintf("%s:%s:%s:%s", mac, nonce, pinId, base64.RawURLEncoding.EncodeToString([]byte(redirect))),
 		Path:     "/",
-		Domain:   csrfCookieDomain(r),
+		Domain:   csrfCookieDomain(cfg, r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !cfg.InsecureCookie,
 		Expires:  time.Now().Local().Add(time.Hour * 1),
 	}
 }
 
 // ClearCSRFCookie makes an expired csrf cookie to clear csrf cookie
-func ClearCSRFCookie(r *http.Request, c *http.Cookie) *http.Cookie {
+func ClearCSRFCookie(cfg *Config, r *http.Request, c *http.Cookie) *http.Cookie {
 	return &http.Cookie{
 		Name:     c.Name,
 		Value:    "",
 		Path:     "/",
-		Domain:   csrfCookieDomain(r),
+		Domain:   csrfCookieDomain(cfg, r),
 		HttpOnly: true,
-		Secure:   !config.InsecureCookie,
+		Secure:   !cfg.InsecureCookie,
 		Expires:  time.Now().Local().Add(time.Hour * -1),
 	}
 }
 
 // FindCSRFCookie extracts the CSRF cookie from the request based on state.
-func FindCSRFCookie(r *http.Request) (c *http.Cookie, err error) {
+func FindCSRFCookie(cfg *Config, r *http.Request) (c *http.Cookie, err error) {
 	// Check for CSRF cookie
-	return r.Cookie(config.CSRFCookieName)
+	return r.Cookie(cfg.CSRFCookieName)
 }
 
 // ValidateCSRFCookie validates the csrf cookie against state
-func ValidateCSRFCookie(c *http.Cookie) (valid bool, pinId string, redirect string, err error) {
-	split := strings.Index(c.Value, ":")
-	if split == -1 {
+func ValidateCSRFCookie(cfg *Config, c *http.Cookie, state string) (valid bool, pinId string, redirect string, err error) {
+	parts := strings.SplitN(c.Value, ":", 4)
+	if len(parts) != 4 {
 		return false, "", "", errors.New("invalid CSRF cookie value")
 	}
 
-	// Valid, return provider and redirect
-	return true, c.Value[:split], c.Value[split+1:], nil
+	mac, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false, "", "", errors.New("unable to decode CSRF cookie mac")
+	}
+
+	redirectBytes, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, "", "", errors.New("unable to decode CSRF cookie redirect")
+	}
+	redirect = string(redirectBytes)
+
+	expected, _ := base64.URLEncoding.DecodeString(csrfSignature(cfg, parts[1], parts[2], redirect))
+	if !hmac.Equal(mac, expected) {
+		return false, "", "", errors.New("invalid CSRF cookie mac")
+	}
+
+	// Check nonce match
+	if len(state) == 0 || subtle.ConstantTimeCompare([]byte(parts[1]), []byte(state)) != 1 {
+		return false, "", "", errors.New("CSRF cookie does not match state")
+	}
+
+	// Valid, return pin id and redirect
+	return true, parts[2], redirect, nil
+}
+
+// ValidateRedirect checks that the given redirect is an absolute http(s) URL
+// for either the host handling the request, a host matching one of the
+// "cookie-domain" config parameters, or one of the "allowed-redirect-host"
+// config parameters
+func ValidateRedirect(cfg *Config, r *http.Request, redirect string) (*url.URL, error) {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return nil, errors.New("unable to parse redirect")
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("invalid redirect URL scheme")
+	}
+
+	host := u.Hostname()
+	if len(host) == 0 {
+		return nil, errors.New("redirect URL has no host")
+	}
+
+	// Same host as the request
+	if host == strings.Split(r.Host, ":")[0] {
+		return u, nil
+	}
+
+	// Matches a cookie domain
+	if match, _ := matchCookieDomains(cfg, host); match {
+		return u, nil
+	}
+
+	// Explicitly allowed
+	for _, allowed := range cfg.AllowedRedirectHosts {
+		if host == allowed {
+			return u, nil
+		}
+	}
+
+	return nil, errors.New("redirect host is not permitted")
+}
+
+// Nonce generates a random nonce
+func Nonce() (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", nonce), nil
 }
 
 // Cookie domain
-func cookieDomain(r *http.Request) string {
+func cookieDomain(cfg *Config, r *http.Request) string {
 	// Check if any of the given cookie domains matches
-	_, domain := matchCookieDomains(r.Host)
+	_, domain := matchCookieDomains(cfg, r.Host)
 	return domain
 }
 
 // Cookie domain
-func csrfCookieDomain(r *http.Request) string {
+func csrfCookieDomain(cfg *Config, r *http.Request) string {
 	var host string
-	if use, domain := useAuthDomain(r); use {
+	if use, domain := useAuthDomain(cfg, r); use {
 		host = domain
 	} else {
 		host = r.Host
@@ -257,11 +595,11 @@ func csrfCookieDomain(r *http.Request) string {
 }
 
 // Return matching cookie domain if exists
-func matchCookieDomains(domain string) (bool, string) {
+func matchCookieDomains(cfg *Config, domain string) (bool, string) {
 	// Remove port
 	p := strings.Split(domain, ":")
 
-	for _, d := range config.CookieDomains {
+	for _, d := range cfg.CookieDomains {
 		if d.Match(p[0]) {
 			return true, d.Domain
 		}
@@ -270,18 +608,49 @@ func matchCookieDomains(domain string) (bool, string) {
 	return false, p[0]
 }
 
-// Create cookie hmac
-func cookieSignature(r *http.Request, email, expires string) string {
-	hash := hmac.New(sha256.New, config.Secret)
-	hash.Write([]byte(cookieDomain(r)))
+// Create legacy v1 cookie hmac, only used to validate existing cookies
+func cookieSignature(cfg *Config, r *http.Request, email, expires string) string {
+	hash := hmac.New(sha256.New, cfg.Secret)
+	hash.Write([]byte(cookieDomain(cfg, r)))
 	hash.Write([]byte(email))
 	hash.Write([]byte(expires))
 	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
 }
 
+// Key derivation info for each use of the secret
+const (
+	cookieKeyInfo = "traefik-forward-auth-plex-sso cookie v2"
+	tokenKeyInfo  = "traefik-forward-auth-plex-sso plex token"
+)
+
+// Create cipher, keyed from the secret
+func newCipher(cfg *Config, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, cfg.Secret, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Create csrf cookie hmac
+func csrfSignature(cfg *Config, nonce, pinId, redirect string) string {
+	hash := hmac.New(sha256.New, cfg.Secret)
+	hash.Write([]byte("csrf"))
+	hash.Write([]byte(nonce))
+	hash.Write([]byte(pinId))
+	hash.Write([]byte(redirect))
+	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
+}
+
 // Get cookie expiry
-func cookieExpiry() time.Time {
-	return time.Now().Local().Add(config.Lifetime)
+func cookieExpiry(cfg *Config) time.Time {
+	return time.Now().Local().Add(cfg.Lifetime)
 }
 
 // CookieDomain holds cookie domain info
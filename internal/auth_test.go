@@ -1,6 +1,7 @@
 package tfaps
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -12,79 +13,193 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// Make an auth cookie, failing the test if it can't be made
+func mustMakeCookie(t *testing.T, r *http.Request, claims Claims) *http.Cookie {
+	t.Helper()
+	c, err := MakeCookie(config, r, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
 /**
  * Tests
  */
 
 func TestAuthValidateCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	setTestConfig([]string{})
 	r, _ := http.NewRequest("GET", "http://example.com", nil)
 	c := &http.Cookie{}
 
 	// Should require 3 parts
 	c.Value = ""
-	_, err := ValidateCookie(r, c)
+	_, err := ValidateCookie(config, r, c)
 	if assert.Error(err) {
 		assert.Equal("Invalid cookie format", err.Error())
 	}
 	c.Value = "1|2"
-	_, err = ValidateCookie(r, c)
+	_, err = ValidateCookie(config, r, c)
 	if assert.Error(err) {
 		assert.Equal("Invalid cookie format", err.Error())
 	}
 	c.Value = "1|2|3|4"
-	_, err = ValidateCookie(r, c)
+	_, err = ValidateCookie(config, r, c)
 	if assert.Error(err) {
 		assert.Equal("Invalid cookie format", err.Error())
 	}
 
 	// Should catch invalid mac
 	c.Value = "MQ==|2|3"
-	_, err = ValidateCookie(r, c)
+	_, err = ValidateCookie(config, r, c)
 	if assert.Error(err) {
 		assert.Equal("Invalid cookie mac", err.Error())
 	}
 
+	// Should catch invalid v2 cookie
+	c.Value = "v2.!!!"
+	_, err = ValidateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Unable to decode cookie", err.Error())
+	}
+	c.Value = "v2.MTIzNDU2Nzg5MDEyMzQ1Njc4OTA"
+	_, err = ValidateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Unable to decrypt cookie", err.Error())
+	}
+
 	// Should catch expired
 	config.Lifetime = time.Second * time.Duration(-1)
-	c = MakeCookie(r, "test@test.com")
-	_, err = ValidateCookie(r, c)
+	c = mustMakeCookie(t, r, NewClaims(config, User{Email: "test@test.com"}, HomeUser))
+	_, err = ValidateCookie(config, r, c)
 	if assert.Error(err) {
 		assert.Equal("Cookie has expired", err.Error())
 	}
 
 	// Should accept valid cookie
 	config.Lifetime = time.Second * time.Duration(10)
-	c = MakeCookie(r, "test@test.com")
-	email, err := ValidateCookie(r, c)
+	c = mustMakeCookie(t, r, NewClaims(config, User{Id: 123, Username: "test", Email: "test@test.com"}, HomeUser))
+	claims, err := ValidateCookie(config, r, c)
+	assert.Nil(err, "valid request should not return an error")
+	assert.Equal(int64(123), claims.UserID, "valid request should return user id")
+	assert.Equal("test", claims.Username, "valid request should return username")
+	assert.Equal("test@test.com", claims.Email, "valid request should return user email")
+	assert.Equal(HomeUser, claims.Tier, "valid request should return access tier")
+	assert.WithinDuration(time.Now(), time.Unix(claims.IssuedAt, 0), 10*time.Second)
+
+	// Should accept email containing the v1 separator
+	c = mustMakeCookie(t, r, NewClaims(config, User{Email: "te|st@test.com"}, HomeUser))
+	claims, err = ValidateCookie(config, r, c)
+	assert.Nil(err, "valid request should not return an error")
+	assert.Equal("te|st@test.com", claims.Email, "valid request should return user email")
+
+	// Should catch a tampered cookie
+	valid := c.Value
+	data, _ := base64.RawURLEncoding.DecodeString(valid[3:])
+	data[len(data)-1] ^= 1
+	c.Value = "v2." + base64.RawURLEncoding.EncodeToString(data)
+	_, err = ValidateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Unable to decrypt cookie", err.Error())
+	}
+
+	// Should catch a cookie for another domain
+	c.Value = valid
+	r2, _ := http.NewRequest("GET", "http://another.com", nil)
+	_, err = ValidateCookie(config, r2, c)
+	if assert.Error(err) {
+		assert.Equal("Unable to decrypt cookie", err.Error())
+	}
+
+	// Should catch a cookie made with another secret
+	config.Secret = []byte("another")
+	_, err = ValidateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Unable to decrypt cookie", err.Error())
+	}
+	config.Secret = []byte{}
+
+	// Should reject v1 cookie with access tier, which was never issued
+	expires := fmt.Sprintf("%d", time.Now().Add(time.Minute).Unix())
+	tier := fmt.Sprintf("%d", Owner)
+	c.Value = fmt.Sprintf("%s|%s|%s|%s", cookieSignature(config, r, "test@test.com", expires+tier), expires, tier, "test@test.com")
+	_, err = ValidateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie format", err.Error())
+	}
+
+	// Should reject v1 cookie where the email and expiry could be split differently
+	c.Value = fmt.Sprintf("%s|%s|%s", cookieSignature(config, r, "test@test.com1", expires), expires, "test@test.com1")
+	_, err = ValidateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Invalid cookie format", err.Error())
+	}
+
+	// Should accept v1 cookie without access tier
+	c.Value = fmt.Sprintf("%s|%s|%s", cookieSignature(config, r, "test@test.com", expires), expires, "test@test.com")
+	claims, err = ValidateCookie(config, r, c)
 	assert.Nil(err, "valid request should not return an error")
-	assert.Equal("test@test.com", email, "valid request should return user email")
+	assert.Equal("test@test.com", claims.Email, "valid request should return user email")
+	assert.Equal(NoAccess, claims.Tier, "cookie without tier should return no access tier")
+
+	// Should catch expired v1 cookie
+	expires = fmt.Sprintf("%d", time.Now().Add(-time.Minute).Unix())
+	c.Value = fmt.Sprintf("%s|%s|%s", cookieSignature(config, r, "test@test.com", expires), expires, "test@test.com")
+	_, err = ValidateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Cookie has expired", err.Error())
+	}
+}
+
+func TestAuthSealToken(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{"--secret=verysecret"})
+
+	sealed, err := SealToken(config, "plextoken")
+	assert.Nil(err)
+	assert.NotContains(sealed, "plextoken", "sealed token should not expose token")
+
+	token, err := OpenToken(config, sealed)
+	assert.Nil(err)
+	assert.Equal("plextoken", token)
+
+	// Should not open with another secret
+	config.Secret = []byte("another")
+	_, err = OpenToken(config, sealed)
+	if assert.Error(err) {
+		assert.Equal("unable to decrypt token", err.Error())
+	}
+
+	_, err = OpenToken(config, "!!!")
+	if assert.Error(err) {
+		assert.Equal("unable to decode token", err.Error())
+	}
 }
 
 func TestAuthValidateEmail(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	setTestConfig([]string{})
 
 	// Should allow any with no whitelist/domain is specified
-	v := ValidateEmail("test@test.com", "default")
+	v := ValidateEmail(config, "test@test.com", "default")
 	assert.True(v, "should allow any domain if email domain is not defined")
-	v = ValidateEmail("one@two.com", "default")
+	v = ValidateEmail(config, "one@two.com", "default")
 	assert.True(v, "should allow any domain if email domain is not defined")
 
 	// Should allow matching domain
 	config.Domains = []string{"test.com"}
-	v = ValidateEmail("one@two.com", "default")
+	v = ValidateEmail(config, "one@two.com", "default")
 	assert.False(v, "should not allow user from another domain")
-	v = ValidateEmail("test@test.com", "default")
+	v = ValidateEmail(config, "test@test.com", "default")
 	assert.True(v, "should allow user from allowed domain")
 
 	// Should allow matching whitelisted email address
 	config.Domains = []string{}
 	config.Whitelist = []string{"test@test.com"}
-	v = ValidateEmail("one@two.com", "default")
+	v = ValidateEmail(config, "one@two.com", "default")
 	assert.False(v, "should not allow user not in whitelist")
-	v = ValidateEmail("test@test.com", "default")
+	v = ValidateEmail(config, "test@test.com", "default")
 	assert.True(v, "should allow user in whitelist")
 
 	// Should allow only matching email address when
@@ -92,11 +207,11 @@ func TestAuthValidateEmail(t *testing.T) {
 	config.Domains = []string{"example.com"}
 	config.Whitelist = []string{"test@test.com"}
 	config.MatchWhitelistOrDomain = false
-	v = ValidateEmail("one@two.com", "default")
+	v = ValidateEmail(config, "one@two.com", "default")
 	assert.False(v, "should not allow user not in either")
-	v = ValidateEmail("test@example.com", "default")
+	v = ValidateEmail(config, "test@example.com", "default")
 	assert.False(v, "should not allow user from allowed domain")
-	v = ValidateEmail("test@test.com", "default")
+	v = ValidateEmail(config, "test@test.com", "default")
 	assert.True(v, "should allow user in whitelist")
 
 	// Should allow either matching domain or email address when
@@ -104,11 +219,11 @@ func TestAuthValidateEmail(t *testing.T) {
 	config.Domains = []string{"example.com"}
 	config.Whitelist = []string{"test@test.com"}
 	config.MatchWhitelistOrDomain = true
-	v = ValidateEmail("one@two.com", "default")
+	v = ValidateEmail(config, "one@two.com", "default")
 	assert.False(v, "should not allow user not in either")
-	v = ValidateEmail("test@example.com", "default")
+	v = ValidateEmail(config, "test@example.com", "default")
 	assert.True(v, "should allow user from allowed domain")
-	v = ValidateEmail("test@test.com", "default")
+	v = ValidateEmail(config, "test@test.com", "default")
 	assert.True(v, "should allow user in whitelist")
 
 	// Rule testing
@@ -118,11 +233,11 @@ func TestAuthValidateEmail(t *testing.T) {
 	config.Whitelist = []string{"test@test.com"}
 	config.Rules = map[string]*Rule{"test": NewRule()}
 	config.MatchWhitelistOrDomain = true
-	v = ValidateEmail("one@two.com", "test")
+	v = ValidateEmail(config, "one@two.com", "test")
 	assert.False(v, "should not allow user not in either")
-	v = ValidateEmail("test@example.com", "test")
+	v = ValidateEmail(config, "test@example.com", "test")
 	assert.True(v, "should allow user from allowed global domain")
-	v = ValidateEmail("test@test.com", "test")
+	v = ValidateEmail(config, "test@test.com", "test")
 	assert.True(v, "should allow user in global whitelist")
 
 	// Should allow matching domain in rule
@@ -132,11 +247,11 @@ func TestAuthValidateEmail(t *testing.T) {
 	config.Rules = map[string]*Rule{"test": rule}
 	rule.Domains = []string{"testrule.com"}
 	config.MatchWhitelistOrDomain = false
-	v = ValidateEmail("one@two.com", "test")
+	v = ValidateEmail(config, "one@two.com", "test")
 	assert.False(v, "should not allow user from another domain")
-	v = ValidateEmail("one@testglobal.com", "test")
+	v = ValidateEmail(config, "one@testglobal.com", "test")
 	assert.False(v, "should not allow user from global domain")
-	v = ValidateEmail("test@testrule.com", "test")
+	v = ValidateEmail(config, "test@testrule.com", "test")
 	assert.True(v, "should allow user from allowed domain")
 
 	// Should allow matching whitelist in rule
@@ -146,11 +261,11 @@ func TestAuthValidateEmail(t *testing.T) {
 	config.Rules = map[string]*Rule{"test": rule}
 	rule.Whitelist = []string{"test@testrule.com"}
 	config.MatchWhitelistOrDomain = false
-	v = ValidateEmail("one@two.com", "test")
+	v = ValidateEmail(config, "one@two.com", "test")
 	assert.False(v, "should not allow user from another domain")
-	v = ValidateEmail("test@testglobal.com", "test")
+	v = ValidateEmail(config, "test@testglobal.com", "test")
 	assert.False(v, "should not allow user from global domain")
-	v = ValidateEmail("test@testrule.com", "test")
+	v = ValidateEmail(config, "test@testrule.com", "test")
 	assert.True(v, "should allow user from allowed domain")
 
 	// Should allow only matching email address when
@@ -162,15 +277,15 @@ func TestAuthValidateEmail(t *testing.T) {
 	rule.Domains = []string{"examplerule.com"}
 	rule.Whitelist = []string{"test@testrule.com"}
 	config.MatchWhitelistOrDomain = false
-	v = ValidateEmail("one@two.com", "test")
+	v = ValidateEmail(config, "one@two.com", "test")
 	assert.False(v, "should not allow user not in either")
-	v = ValidateEmail("test@testglobal.com", "test")
+	v = ValidateEmail(config, "test@testglobal.com", "test")
 	assert.False(v, "should not allow user in global whitelist")
-	v = ValidateEmail("test@exampleglobal.com", "test")
+	v = ValidateEmail(config, "test@exampleglobal.com", "test")
 	assert.False(v, "should not allow user from global domain")
-	v = ValidateEmail("test@examplerule.com", "test")
+	v = ValidateEmail(config, "test@examplerule.com", "test")
 	assert.False(v, "should not allow user from allowed domain")
-	v = ValidateEmail("test@testrule.com", "test")
+	v = ValidateEmail(config, "test@testrule.com", "test")
 	assert.True(v, "should allow user in whitelist")
 
 	// Should allow either matching domain or email address when
@@ -182,18 +297,50 @@ func TestAuthValidateEmail(t *testing.T) {
 	rule.Domains = []string{"examplerule.com"}
 	rule.Whitelist = []string{"test@testrule.com"}
 	config.MatchWhitelistOrDomain = true
-	v = ValidateEmail("one@two.com", "test")
+	v = ValidateEmail(config, "one@two.com", "test")
 	assert.False(v, "should not allow user not in either")
-	v = ValidateEmail("test@testglobal.com", "test")
+	v = ValidateEmail(config, "test@testglobal.com", "test")
 	assert.False(v, "should not allow user in global whitelist")
-	v = ValidateEmail("test@exampleglobal.com", "test")
+	v = ValidateEmail(config, "test@exampleglobal.com", "test")
 	assert.False(v, "should not allow user from global domain")
-	v = ValidateEmail("test@examplerule.com", "test")
+	v = ValidateEmail(config, "test@examplerule.com", "test")
 	assert.True(v, "should allow user from allowed domain")
-	v = ValidateEmail("test@testrule.com", "test")
+	v = ValidateEmail(config, "test@testrule.com", "test")
 	assert.True(v, "should allow user in whitelist")
 }
 
+func TestAuthValidateAccessTier(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{})
+
+	// Should allow any tier when no minimum is specified
+	assert.True(ValidateAccessTier(config, NoAccess, "default"))
+	assert.True(ValidateAccessTier(config, NormalUser, "default"))
+
+	// Should use global minimum tier
+	config.MinTier = HomeUser
+	assert.False(ValidateAccessTier(config, NoAccess, "default"), "should not allow no access")
+	assert.False(ValidateAccessTier(config, NormalUser, "default"), "should not allow lower tier")
+	assert.True(ValidateAccessTier(config, HomeUser, "default"), "should allow equal tier")
+	assert.True(ValidateAccessTier(config, Owner, "default"), "should allow higher tier")
+
+	// Should use global minimum tier when not specified on rule
+	config.Rules = map[string]*Rule{"test": NewRule()}
+	assert.False(ValidateAccessTier(config, NormalUser, "test"), "should not allow lower tier")
+	assert.True(ValidateAccessTier(config, HomeUser, "test"), "should allow equal tier")
+
+	// Should override global minimum tier with rule tier
+	rule := NewRule()
+	rule.Tier = Owner
+	config.Rules = map[string]*Rule{"test": rule}
+	assert.False(ValidateAccessTier(config, HomeUser, "test"), "should not allow lower tier than rule")
+	assert.True(ValidateAccessTier(config, Owner, "test"), "should allow rule tier")
+
+	rule.Tier = NormalUser
+	assert.True(ValidateAccessTier(config, NormalUser, "test"), "should allow lower tier than global")
+	assert.False(ValidateAccessTier(config, NoAccess, "test"), "should not allow no access")
+}
+
 func TestRedirectUri(t *testing.T) {
 	assert := assert.New(t)
 
@@ -203,9 +350,9 @@ func TestRedirectUri(t *testing.T) {
 	//
 	// No Auth Host
 	//
-	config, _ = NewConfig([]string{})
+	setTestConfig([]string{})
 
-	uri, err := url.Parse(redirectUri(r))
+	uri, err := url.Parse(redirectUri(config, r))
 	assert.Nil(err)
 	assert.Equal("http", uri.Scheme)
 	assert.Equal("app.example.com", uri.Host)
@@ -217,7 +364,7 @@ func TestRedirectUri(t *testing.T) {
 	//
 	config.AuthHost = "auth.example.com"
 
-	uri, err = url.Parse(redirectUri(r))
+	uri, err = url.Parse(redirectUri(config, r))
 	assert.Nil(err)
 	assert.Equal("http", uri.Scheme)
 	assert.Equal("app.example.com", uri.Host)
@@ -230,7 +377,7 @@ func TestRedirectUri(t *testing.T) {
 	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
 
 	// Check url
-	uri, err = url.Parse(redirectUri(r))
+	uri, err = url.Parse(redirectUri(config, r))
 	assert.Nil(err)
 	assert.Equal("http", uri.Scheme)
 	assert.Equal("auth.example.com", uri.Host)
@@ -247,24 +394,60 @@ func TestRedirectUri(t *testing.T) {
 	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
 
 	// Check url
-	uri, err = url.Parse(redirectUri(r))
+	uri, err = url.Parse(redirectUri(config, r))
 	assert.Nil(err)
 	assert.Equal("https", uri.Scheme)
 	assert.Equal("another.com", uri.Host)
 	assert.Equal("/_oauth", uri.Path)
 }
 
+func TestAuthReturnUrl(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{})
+
+	r := httptest.NewRequest("GET", "http://app.example.com/graphs/1?range=7d&type=plays", nil)
+	r.Header.Add("X-Forwarded-Proto", "https")
+
+	// Should keep path and query
+	assert.Equal("https://app.example.com/graphs/1?range=7d&type=plays", returnUrl(r))
+	assert.Equal("https://app.example.com/graphs/1?range=7d&type=plays", loginReturnUrl(r))
+
+	// Should include forwarded prefix
+	r.Header.Set("X-Forwarded-Prefix", "/tautulli/")
+	assert.Equal("https://app.example.com/tautulli/graphs/1?range=7d&type=plays", returnUrl(r))
+	r.Header.Set("X-Forwarded-Prefix", "//evil.com")
+	assert.Equal("https://app.example.com/evil.com/graphs/1?range=7d&type=plays", returnUrl(r))
+	r.Header.Del("X-Forwarded-Prefix")
+
+	// Should drop query if too long
+	long := strings.Repeat("a", maxReturnUrlLength)
+	r = httptest.NewRequest("GET", "http://app.example.com/graphs/1?q="+long, nil)
+	r.Header.Add("X-Forwarded-Proto", "https")
+	assert.Equal("https://app.example.com/graphs/1", loginReturnUrl(r))
+
+	// Should fall back to root if path is too long
+	r = httptest.NewRequest("GET", "http://app.example.com/"+long, nil)
+	r.Header.Add("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Prefix", "/tautulli")
+	assert.Equal("https://app.example.com/tautulli/", loginReturnUrl(r))
+
+	// Should fall back to host if prefix is too long
+	r.Header.Set("X-Forwarded-Prefix", long)
+	assert.Equal("https://app.example.com", loginReturnUrl(r))
+}
+
 func TestAuthMakeCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	setTestConfig([]string{})
 	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
 	r.Header.Add("X-Forwarded-Host", "app.example.com")
 
-	c := MakeCookie(r, "test@example.com")
+	c, err := MakeCookie(config, r, NewClaims(config, User{Email: "test@example.com"}, Owner))
+	assert.Nil(err)
 	assert.Equal("_forward_auth", c.Name)
-	parts := strings.Split(c.Value, "|")
-	assert.Len(parts, 3, "cookie should be 3 parts")
-	_, err := ValidateCookie(r, c)
+	assert.True(strings.HasPrefix(c.Value, "v2."), "cookie should be v2 format")
+	assert.NotContains(c.Value, "test@example.com", "cookie should not expose email")
+	_, err = ValidateCookie(config, r, c)
 	assert.Nil(err, "should generate valid cookie")
 	assert.Equal("/", c.Path)
 	assert.Equal("app.example.com", c.Domain)
@@ -275,47 +458,49 @@ func TestAuthMakeCookie(t *testing.T) {
 
 	config.CookieName = "testname"
 	config.InsecureCookie = true
-	c = MakeCookie(r, "test@example.com")
+	c = mustMakeCookie(t, r, NewClaims(config, User{Email: "test@example.com"}, Owner))
 	assert.Equal("testname", c.Name)
 	assert.False(c.Secure)
 }
 
 func TestAuthMakeCSRFCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	setTestConfig([]string{})
 	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
 	r.Header.Add("X-Forwarded-Host", "app.example.com")
-	redirectUri := "http://app.example.com/_oauth"
-	pinId := "12345678901234567890123456789012"
+	redirect := "http://app.example.com/hello"
+	nonce := "12345678901234567890123456789012"
+	pinId := "1234"
+	expected := fmt.Sprintf("%s:%s:%s:%s", csrfSignature(config, nonce, pinId, redirect), nonce, pinId, "aHR0cDovL2FwcC5leGFtcGxlLmNvbS9oZWxsbw")
 
 	// No cookie domain or auth url
-	c := MakeCSRFCookie(r, pinId, redirectUri)
+	c := MakeCSRFCookie(config, r, nonce, pinId, redirect)
 	assert.Equal("_forward_auth_csrf", c.Name)
 	assert.Equal("app.example.com", c.Domain)
-	assert.Equal(fmt.Sprintf("%s:%s", pinId, redirectUri), c.Value)
+	assert.Equal(expected, c.Value)
 
 	// With cookie domain but no auth url
 	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
-	c = MakeCSRFCookie(r, pinId, redirectUri)
+	c = MakeCSRFCookie(config, r, nonce, pinId, redirect)
 	assert.Equal("_forward_auth_csrf", c.Name)
 	assert.Equal("app.example.com", c.Domain)
-	assert.Equal(fmt.Sprintf("%s:%s", pinId, redirectUri), c.Value)
+	assert.Equal(expected, c.Value)
 
 	// With cookie domain and auth url
 	config.AuthHost = "auth.example.com"
 	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
-	c = MakeCSRFCookie(r, pinId, redirectUri)
+	c = MakeCSRFCookie(config, r, nonce, pinId, redirect)
 	assert.Equal("_forward_auth_csrf", c.Name)
 	assert.Equal("example.com", c.Domain)
-	assert.Equal(fmt.Sprintf("%s:%s", pinId, redirectUri), c.Value)
+	assert.Equal(expected, c.Value)
 }
 
 func TestAuthClearCSRFCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	setTestConfig([]string{})
 	r, _ := http.NewRequest("GET", "http://example.com", nil)
 
-	c := ClearCSRFCookie(r, &http.Cookie{Name: "someCsrfCookie"})
+	c := ClearCSRFCookie(config, r, &http.Cookie{Name: "someCsrfCookie"})
 	assert.Equal("someCsrfCookie", c.Name)
 	if c.Value != "" {
 		t.Error("ClearCSRFCookie should create cookie with empty value")
@@ -324,38 +509,137 @@ func TestAuthClearCSRFCookie(t *testing.T) {
 
 func TestAuthValidateCSRFCookie(t *testing.T) {
 	assert := assert.New(t)
-	config, _ = NewConfig([]string{})
+	setTestConfig([]string{})
+	r, _ := http.NewRequest("GET", "http://app.example.com", nil)
+	nonce := "12345678901234567890123456789012"
 	c := &http.Cookie{}
 
-	// Should require 32 char string
+	// Should require 4 parts
 	c.Value = ""
-	valid, _, _, err := ValidateCSRFCookie(c)
+	valid, _, _, err := ValidateCSRFCookie(config, c, nonce)
 	assert.False(valid)
 	if assert.Error(err) {
 		assert.Equal("invalid CSRF cookie value", err.Error())
 	}
-	c.Value = "123456789012345678901234567890123"
-	valid, _, _, err = ValidateCSRFCookie(c)
+	c.Value = "mac:12345678901234567890123456789012:1234"
+	valid, _, _, err = ValidateCSRFCookie(config, c, nonce)
 	assert.False(valid)
 	if assert.Error(err) {
 		assert.Equal("invalid CSRF cookie value", err.Error())
 	}
 
-	// Should require provider
-	c.Value = "12345678901234567890123456789012"
-	valid, _, _, err = ValidateCSRFCookie(c)
+	// Should require encoded redirect
+	c.Value = "MQ==:12345678901234567890123456789012:1234:http://app.example.com"
+	valid, _, _, err = ValidateCSRFCookie(config, c, nonce)
 	assert.False(valid)
 	if assert.Error(err) {
-		assert.Equal("invalid CSRF cookie value", err.Error())
+		assert.Equal("unable to decode CSRF cookie redirect", err.Error())
+	}
+
+	// Should require valid signature
+	c.Value = "MQ==:12345678901234567890123456789012:1234:aHR0cDovL2FwcC5leGFtcGxlLmNvbQ"
+	valid, _, _, err = ValidateCSRFCookie(config, c, nonce)
+	assert.False(valid)
+	if assert.Error(err) {
+		assert.Equal("invalid CSRF cookie mac", err.Error())
+	}
+
+	// Should catch an unsigned redirect
+	c = MakeCSRFCookie(config, r, nonce, "1234", "http://app.example.com")
+	parts := strings.Split(c.Value, ":")
+	parts[3] = base64.RawURLEncoding.EncodeToString([]byte("http://evil.com"))
+	c.Value = strings.Join(parts, ":")
+	valid, _, _, err = ValidateCSRFCookie(config, c, nonce)
+	assert.False(valid)
+	if assert.Error(err) {
+		assert.Equal("invalid CSRF cookie mac", err.Error())
+	}
+
+	// Should require matching state
+	c = MakeCSRFCookie(config, r, nonce, "1234", "http://app.example.com")
+	valid, _, _, err = ValidateCSRFCookie(config, c, "")
+	assert.False(valid)
+	if assert.Error(err) {
+		assert.Equal("CSRF cookie does not match state", err.Error())
+	}
+	valid, _, _, err = ValidateCSRFCookie(config, c, "12345678901234567890123456789013")
+	assert.False(valid)
+	if assert.Error(err) {
+		assert.Equal("CSRF cookie does not match state", err.Error())
 	}
 
 	// Should allow valid state
-	c.Value = "12345678901234567890123456789012:url123"
-	valid, pinId, redirect, err := ValidateCSRFCookie(c)
+	c = MakeCSRFCookie(config, r, nonce, "1234", "http://app.example.com")
+	valid, pinId, redirect, err := ValidateCSRFCookie(config, c, nonce)
+	assert.True(valid, "valid request should return valid")
+	assert.Nil(err, "valid request should not return an error")
+	assert.Equal("1234", pinId, "valid request should return correct pin id")
+	assert.Equal("http://app.example.com", redirect, "valid request should return correct redirect")
+
+	// Should preserve redirect with characters not permitted in cookies
+	c = MakeCSRFCookie(config, r, nonce, "1234", "http://app.example.com/a?b=\"c\";d")
+	valid, _, redirect, err = ValidateCSRFCookie(config, c, nonce)
 	assert.True(valid, "valid request should return valid")
 	assert.Nil(err, "valid request should not return an error")
-	assert.Equal("12345678901234567890123456789012", pinId, "valid request should return correct provider")
-	assert.Equal("url123", redirect, "valid request should return correct redirect")
+	assert.Equal("http://app.example.com/a?b=\"c\";d", redirect, "valid request should return correct redirect")
+}
+
+func TestAuthValidateRedirect(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{})
+	r := httptest.NewRequest("GET", "http://app.example.com:8080/_oauth", nil)
+
+	errorCases := map[string]string{
+		"::":                      "unable to parse redirect",
+		"/hello":                  "invalid redirect URL scheme",
+		"javascript:alert(1)":     "invalid redirect URL scheme",
+		"http:///hello":           "redirect URL has no host",
+		"http://evil.com/hello":   "redirect host is not permitted",
+		"https://other.app.com/x": "redirect host is not permitted",
+	}
+	for redirect, expected := range errorCases {
+		_, err := ValidateRedirect(config, r, redirect)
+		if assert.Error(err, redirect) {
+			assert.Equal(expected, err.Error(), redirect)
+		}
+	}
+
+	// Should allow same host
+	u, err := ValidateRedirect(config, r, "https://app.example.com/hello")
+	assert.Nil(err)
+	assert.Equal("https://app.example.com/hello", u.String())
+
+	// Should allow cookie domain
+	_, err = ValidateRedirect(config, r, "https://other.example.com/hello")
+	if assert.Error(err) {
+		assert.Equal("redirect host is not permitted", err.Error())
+	}
+	config.CookieDomains = []CookieDomain{*NewCookieDomain("example.com")}
+	_, err = ValidateRedirect(config, r, "https://other.example.com/hello")
+	assert.Nil(err)
+	_, err = ValidateRedirect(config, r, "https://evilexample.com/hello")
+	assert.Error(err, "derived domain should not be permitted")
+
+	// Should allow allowed redirect host
+	config.AllowedRedirectHosts = CommaSeparatedList{"other.app.com"}
+	_, err = ValidateRedirect(config, r, "https://other.app.com/x")
+	assert.Nil(err)
+	_, err = ValidateRedirect(config, r, "https://sub.other.app.com/x")
+	assert.Error(err, "subdomain of allowed host should not be permitted")
+}
+
+func TestAuthNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	n1, err := Nonce()
+	assert.Nil(err, "error generating nonce")
+	assert.Len(n1, 32, "length should be 32 chars")
+
+	n2, err := Nonce()
+	assert.Nil(err, "error generating nonce")
+	assert.Len(n2, 32, "length should be 32 chars")
+
+	assert.NotEqual(n1, n2, "nonce should not be equal")
 }
 
 func TestAuthCookieDomainMatch(t *testing.T) {
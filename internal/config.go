@@ -6,69 +6,165 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"html/template"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/thomseddon/go-flags"
+	muxhttp "github.com/traefik/traefik/v2/pkg/muxer/http"
 )
 
-var config *Config
+// The current config, which can be replaced when reloading, so must be read
+// with currentConfig
+var (
+	config   *Config
+	configMu sync.RWMutex
+)
+
+// currentConfig returns the current config
+func currentConfig() *Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// setConfig replaces the current config
+func setConfig(c *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = c
+}
 
 // Config holds the runtime application config
 type Config struct {
 	LogLevel  string `long:"log-level" env:"LOG_LEVEL" default:"warn" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
 	LogFormat string `long:"log-format"  env:"LOG_FORMAT" default:"text" choice:"text" choice:"json" choice:"pretty" description:"Log format"`
 
+	AllowedRedirectHosts   CommaSeparatedList   `long:"allowed-redirect-host" env:"ALLOWED_REDIRECT_HOST" env-delim:"," description:"Additional hosts users may be redirected to following login, can be set multiple times"`
+	APIKeyHeader           string               `long:"api-key-header" env:"API_KEY_HEADER" description:"Header API keys can be passed in, in addition to the Authorization header as a bearer token"`
 	AuthHost               string               `long:"auth-host" env:"AUTH_HOST" description:"Single host to use when returning from 3rd party auth"`
 	Config                 func(s string) error `long:"config" env:"CONFIG" description:"Path to config file" json:"-"`
 	CookieDomains          []CookieDomain       `long:"cookie-domain" env:"COOKIE_DOMAIN" env-delim:"," description:"Domain to set auth cookie on, can be set multiple times"`
 	InsecureCookie         bool                 `long:"insecure-cookie" env:"INSECURE_COOKIE" description:"Use insecure cookies"`
 	CookieName             string               `long:"cookie-name" env:"COOKIE_NAME" default:"_forward_auth" description:"Cookie Name"`
 	CSRFCookieName         string               `long:"csrf-cookie-name" env:"CSRF_COOKIE_NAME" default:"_forward_auth_csrf" description:"CSRF Cookie Name"`
-	DefaultAction          string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" description:"Default action"`
+	DefaultAction          string               `long:"default-action" env:"DEFAULT_ACTION" default:"auth" choice:"auth" choice:"allow" choice:"deny" description:"Default action"`
 	Domains                CommaSeparatedList   `long:"domain" env:"DOMAIN" env-delim:"," description:"Only allow given email domains, can be set multiple times"`
+	JWTHeader              string               `long:"jwt-header" env:"JWT_HEADER" description:"Header to pass a signed JWT identifying the user in (requires jwt-key)"`
+	JWTKeys                []string             `long:"jwt-key" env:"JWT_KEY" env-delim:"," description:"Path to a PEM encoded RSA, ECDSA P-256 or Ed25519 private key to sign JWTs with, can be set multiple times, the first is used for signing and all are published"`
+	JWTLifetimeString      int                  `long:"jwt-lifetime" env:"JWT_LIFETIME" default:"60" description:"Lifetime of signed JWTs in seconds"`
 	LifetimeString         int                  `long:"lifetime" env:"LIFETIME" default:"43200" description:"Lifetime in seconds"`
+	LoginRateLimit         int                  `long:"login-rate-limit" env:"LOGIN_RATE_LIMIT" default:"10" description:"Logins each client IP can start per minute, as each creates a PIN with Plex, 0 to disable"`
 	LogoutRedirect         string               `long:"logout-redirect" env:"LOGOUT_REDIRECT" description:"URL to redirect to following logout"`
 	MatchWhitelistOrDomain bool                 `long:"match-whitelist-or-domain" env:"MATCH_WHITELIST_OR_DOMAIN" description:"Allow users that match *either* whitelist or domain (enabled by default in v3)"`
+	MinTier                AccessTier           `long:"min-tier" env:"MIN_TIER" description:"Minimum Plex server access tier required, can be \"owner\", \"home\" or \"friend\" (requires server-identifier)"`
 	Path                   string               `long:"url-path" env:"URL_PATH" default:"/_oauth" description:"Callback URL Path"`
-	SecretString           string               `long:"secret" env:"SECRET" description:"Secret used for signing (required)" json:"-"`
+	RecheckIntervalString  int                  `long:"recheck-interval" env:"RECHECK_INTERVAL" default:"0" description:"Interval in seconds to re-verify a user's server access tier, 0 to disable (requires server-identifier)"`
+	RecheckGraceString     int                  `long:"recheck-grace" env:"RECHECK_GRACE" default:"3600" description:"Time in seconds to keep trusting a user's last known access tier while Plex can't be reached"`
+	RulesDir               string               `long:"rules-dir" env:"RULES_DIR" description:"Directory of *.ini and *.yaml rule files to load, reloaded when they change"`
+	ResponseHeaders        []ResponseHeader     `long:"response-header" env:"RESPONSE_HEADER" description:"Header to add to authenticated responses, in the format \"<name>: <template>\", can be set multiple times"`
+	SecretString           string               `long:"secret" env:"SECRET" description:"Secret used for signing (required, unless state-dir is set)" json:"-"`
+	SessionStore           string               `long:"session-store" env:"SESSION_STORE" default:"none" choice:"none" choice:"memory" choice:"file" description:"Store sessions server side so they can be revoked"`
+	SessionStorePath       string               `long:"session-store-path" env:"SESSION_STORE_PATH" description:"Directory to store sessions in when using the file session store"`
+	SessionAdmins          CommaSeparatedList   `long:"session-admin" env:"SESSION_ADMIN" env-delim:"," description:"Users permitted to list and revoke sessions, can be set multiple times"`
+	StateDir               string               `long:"state-dir" env:"STATE_DIR" description:"Directory to persist the generated client identifier, and secret if not set, across restarts"`
+	TokenAuth              bool                 `long:"token-auth" env:"TOKEN_AUTH" description:"Allow API clients to authenticate with a Plex token in the X-Plex-Token header or query parameter"`
+	WatchConfig            bool                 `long:"watch-config" env:"WATCH_CONFIG" description:"Reload the config when a config file changes, as well as on SIGHUP"`
 	Whitelist              CommaSeparatedList   `long:"whitelist" env:"WHITELIST" env-delim:"," description:"Only allow given email addresses, can be set multiple times"`
 	Port                   int                  `long:"port" env:"PORT" default:"4181" description:"Port to listen on"`
 	Product                string               `long:"product" env:"PRODUCT" default:"traefik-forward-auth-plex-sso" description:"Identity of this service to send to Plex in X-Plex-Product header"`
+	PlexDevice             string               `long:"plex-device" env:"PLEX_DEVICE" description:"Device type to send to Plex in X-Plex-Device header"`
+	PlexDeviceName         string               `long:"plex-device-name" env:"PLEX_DEVICE_NAME" description:"Device name to send to Plex in X-Plex-Device-Name header"`
+	PlexModel              string               `long:"plex-model" env:"PLEX_MODEL" description:"Device model to send to Plex in X-Plex-Model header"`
+	PlexPlatform           string               `long:"plex-platform" env:"PLEX_PLATFORM" description:"Platform to send to Plex in X-Plex-Platform header"`
+	PlexPlatformVersion    string               `long:"plex-platform-version" env:"PLEX_PLATFORM_VERSION" description:"Platform version to send to Plex in X-Plex-Platform-Version header"`
+	PlexVersion            string               `long:"plex-version" env:"PLEX_VERSION" description:"Version of this service to send to Plex in X-Plex-Version header"`
+	PlexURL                string               `long:"plex-url" env:"PLEX_URL" default:"https://plex.tv" description:"Base URL of the Plex API"`
+	PlexLoginURL           string               `long:"plex-login-url" env:"PLEX_LOGIN_URL" default:"https://app.plex.tv/auth/#!" description:"URL of the Plex login page users are redirected to"`
+	PlexTimeoutString      int                  `long:"plex-timeout" env:"PLEX_TIMEOUT" default:"10" description:"Time in seconds to wait for each request to Plex"`
+	PlexCacheTTLString     int                  `long:"plex-cache-ttl" env:"PLEX_CACHE_TTL" default:"60" description:"Time in seconds to cache the users and access tiers returned by Plex, 0 to disable"`
+	PlexRetries            int                  `long:"plex-retries" env:"PLEX_RETRIES" default:"2" description:"Number of times to retry requests to Plex that fail with a server error, or are rate limited"`
+	RevokePlexToken        bool                 `long:"revoke-plex-token" env:"REVOKE_PLEX_TOKEN" description:"Remove this service from the user's authorized Plex devices on logout, and when sessions expire if using a session store"`
 	ClientIdentifierString string               `long:"client-identifier" env:"CLIENT_IDENTIFIER" description:"Client identifier of this service to send to Plex in X-Plex-Client-Identifier header" json:"-"`
 	ServerIdentifier       string               `long:"server-identifier" env:"SERVER_IDENTIFIER" description:"Identifier for the server that users must be members of to successfully authenticate"`
 
-	Rules map[string]*Rule `long:"rule.<name>.<param>" description:"Rule definitions, param can be: \"action\" or \"rule\""`
+	Rules   map[string]*Rule   `long:"rule.<name>.<param>" description:"Rule definitions, param can be: \"action\", \"rule\", \"priority\", \"whitelist\", \"domains\", \"tier\", \"status\", \"redirect\" or \"template\""`
+	APIKeys map[string]*APIKey `long:"api-key.<name>.<param>" description:"API key definitions, param can be: \"hash\", \"identity\", \"rules\", \"tier\" or \"expires\"" json:"-"`
 
 	// Filled during transformations
 	Secret           []byte `json:"-"`
 	Lifetime         time.Duration
+	JWTLifetime      time.Duration
+	RecheckInterval  time.Duration
+	RecheckGrace     time.Duration
+	PlexTimeout      time.Duration
+	PlexCacheTTL     time.Duration
 	ClientIdentifier string `json:"-"`
+
+	// Config files that were parsed
+	files []string
+
+	// Rule files found in the rules dir, and any errors loading them
+	ruleFiles      []string
+	ruleFileErrors []error
+
+	// Environment variables starting with "RULE_" that aren't rule params
+	ruleEnvSkipped []string
+
+	// Whether the secret was generated in the state dir
+	stateSecretCreated bool
+
+	// Keys loaded from the "jwt-key" files, the first is used for signing
+	jwtKeys []*JWTKey
+
+	// Rule params set by flags rather than config files
+	ruleFlags   map[string]bool
+	parsingFile bool
 }
 
 // NewGlobalConfig creates a new global config, parsed from command arguments
-func NewGlobalConfig() *Config {
-	var err error
-	config, err = NewConfig(os.Args[1:])
+func NewGlobalConfig(args []string) *Config {
+	return newGlobalConfig(args, true)
+}
+
+// NewGlobalConfigReadOnly creates a new global config like NewGlobalConfig,
+// but doesn't create any files in the state dir, for commands that only check
+// the config
+func NewGlobalConfigReadOnly(args []string) *Config {
+	return newGlobalConfig(args, false)
+}
+
+func newGlobalConfig(args []string, persistState bool) *Config {
+	c, err := newConfig(args, persistState)
 	if err != nil {
 		fmt.Printf("%+v\n", err)
 		os.Exit(1)
 	}
 
-	return config
+	setConfig(c)
+	return c
 }
 
 // TODO: move config parsing into new func "NewParsedConfig"
 
 // NewConfig parses and validates provided configuration into a config object
 func NewConfig(args []string) (*Config, error) {
+	return newConfig(args, true)
+}
+
+func newConfig(args []string, persistState bool) (*Config, error) {
 	c := &Config{
-		Rules: map[string]*Rule{},
+		Rules:   map[string]*Rule{},
+		APIKeys: map[string]*APIKey{},
 	}
 
 	err := c.parseFlags(args)
@@ -89,12 +185,31 @@ func NewConfig(args []string) (*Config, error) {
 	}
 	c.Secret = []byte(c.SecretString)
 	c.Lifetime = time.Second * time.Duration(c.LifetimeString)
+	c.JWTLifetime = time.Second * time.Duration(c.JWTLifetimeString)
+	c.RecheckInterval = time.Second * time.Duration(c.RecheckIntervalString)
+	c.RecheckGrace = time.Second * time.Duration(c.RecheckGraceString)
+	c.PlexTimeout = time.Second * time.Duration(c.PlexTimeoutString)
+	c.PlexCacheTTL = time.Second * time.Duration(c.PlexCacheTTLString)
 	if len(c.ClientIdentifierString) == 0 {
 		c.ClientIdentifier = uuid.New().String()
 	} else {
 		c.ClientIdentifier = c.ClientIdentifierString
 	}
 
+	if len(c.StateDir) > 0 {
+		err = c.loadState(persistState)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	if len(c.RulesDir) > 0 {
+		err = c.loadRulesDir()
+		if err != nil {
+			return c, err
+		}
+	}
+
 	return c, nil
 }
 
@@ -104,79 +219,229 @@ func (c *Config) parseFlags(args []string) error {
 
 	i := flags.NewIniParser(p)
 	c.Config = func(s string) error {
-		// Try parsing at as an ini
-		err := i.ParseFile(s)
-		return err
+		// Remember the file so it can be watched for changes
+		c.files = append(c.files, s)
+
+		c.parsingFile = true
+		defer func() {
+			c.parsingFile = false
+		}()
+		return parseConfigFile(i, s)
 	}
 
+	c.ruleFlags = map[string]bool{}
 	_, err := p.ParseArgs(args)
 	if err != nil {
 		return handleFlagError(err)
 	}
 
-	return nil
+	return c.parseRuleEnv(os.Environ())
 }
 
 func (c *Config) parseUnknownFlag(option string, arg flags.SplitArgument, args []string) ([]string, error) {
-	// Parse rules in the format "rule.<name>.<param>"
+	// Parse rules in the format "rule.<name>.<param>" and api keys in the
+	// format "api-key.<name>.<param>"
 	parts := strings.Split(option, ".")
-	if len(parts) == 3 && parts[0] == "rule" {
-		// Ensure there is a name
-		name := parts[1]
-		if len(name) == 0 {
-			return args, errors.New("route name is required")
+	if len(parts) != 3 || (parts[0] != "rule" && parts[0] != "api-key") {
+		return args, fmt.Errorf("unknown flag: %v", option)
+	}
+
+	// Ensure there is a name
+	name := parts[1]
+	if len(name) == 0 {
+		if parts[0] == "api-key" {
+			return args, errors.New("api key name is required")
 		}
+		return args, errors.New("route name is required")
+	}
+
+	// Get value, or pop the next arg
+	val, ok := arg.Value()
+	if !ok && len(args) > 1 {
+		val = args[0]
+		args = args[1:]
+	}
+
+	// Check value
+	if len(val) == 0 {
+		if parts[0] == "api-key" {
+			return args, errors.New("api key param value is required")
+		}
+		return args, errors.New("route param value is required")
+	}
+
+	// Unquote if required
+	val, err := unquoteParam(val)
+	if err != nil {
+		return args, err
+	}
+
+	if parts[0] == "api-key" {
+		return args, c.setAPIKeyParam(option, name, parts[2], val)
+	}
+
+	// Remember params set by flags, which take precedence over the environment
+	if !c.parsingFile {
+		c.ruleFlags[name+"."+parts[2]] = true
+	}
+
+	return args, c.setRuleParam(option, name, parts[2], val)
+}
+
+func unquoteParam(val string) (string, error) {
+	if len(val) > 0 && val[0] == '"' {
+		return strconv.Unquote(val)
+	}
+
+	return val, nil
+}
+
+// Params that can be set for a rule
+var ruleParams = map[string]bool{
+	"action":    true,
+	"rule":      true,
+	"priority":  true,
+	"whitelist": true,
+	"domains":   true,
+	"tier":      true,
+	"status":    true,
+	"redirect":  true,
+	"template":  true,
+}
 
-		// Get value, or pop the next arg
-		val, ok := arg.Value()
-		if !ok && len(args) > 1 {
-			val = args[0]
-			args = args[1:]
+// Parse rules in the format "RULE_<NAME>_<PARAM>" from the environment. Names
+// are lower cased, so "RULE_ADMIN_ACTION" sets "rule.admin.action". These
+// override rules from config files, but not flags. Other variables starting
+// with "RULE_" may belong to something else, so are skipped
+func (c *Config) parseRuleEnv(environ []string) error {
+	sort.Strings(environ)
+	for _, env := range environ {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "RULE_") {
+			continue
 		}
 
-		// Check value
-		if len(val) == 0 {
-			return args, errors.New("route param value is required")
+		// Names can contain underscores, so match the param
+		key := strings.TrimPrefix(parts[0], "RULE_")
+		sep := strings.LastIndex(key, "_")
+		if sep < 1 || !ruleParams[strings.ToLower(key[sep+1:])] {
+			c.ruleEnvSkipped = append(c.ruleEnvSkipped, parts[0])
+			continue
 		}
+		name := strings.ToLower(key[:sep])
+		param := strings.ToLower(key[sep+1:])
 
-		// Unquote if required
-		if val[0] == '"' {
-			var err error
-			val, err = strconv.Unquote(val)
-			if err != nil {
-				return args, err
-			}
+		if c.ruleFlags[name+"."+param] {
+			continue
 		}
 
-		// Get or create rule
-		rule, ok := c.Rules[name]
-		if !ok {
-			rule = NewRule()
-			c.Rules[name] = rule
+		if len(parts[1]) == 0 {
+			return fmt.Errorf("route param value is required for %s", parts[0])
+		}
+		val, err := unquoteParam(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", parts[0], err)
 		}
 
-		// Add param value to rule
-		switch parts[2] {
-		case "action":
-			rule.Action = val
-		case "rule":
-			rule.Rule = val
-		case "whitelist":
-			list := CommaSeparatedList{}
-			list.UnmarshalFlag(val)
-			rule.Whitelist = list
-		case "domains":
-			list := CommaSeparatedList{}
-			list.UnmarshalFlag(val)
-			rule.Domains = list
-		default:
-			return args, fmt.Errorf("invalid route param: %v", option)
+		err = c.setRuleParam(parts[0], name, param, val)
+		if err != nil {
+			return err
 		}
-	} else {
-		return args, fmt.Errorf("unknown flag: %v", option)
 	}
 
-	return args, nil
+	return nil
+}
+
+// Log environment variables that were skipped when parsing rules
+func (c *Config) logRuleEnvSkipped() {
+	for _, env := range c.ruleEnvSkipped {
+		log.WithField("variable", env).Warn("Skipping environment variable, not in the format RULE_<NAME>_<PARAM>")
+	}
+}
+
+func (c *Config) setRuleParam(option, name, param, val string) error {
+	// Get or create rule
+	rule, ok := c.Rules[name]
+	if !ok {
+		rule = NewRule()
+		c.Rules[name] = rule
+	}
+
+	// Add param value to rule
+	switch param {
+	case "action":
+		rule.Action = val
+	case "rule":
+		rule.Rule = val
+	case "priority":
+		priority, err := strconv.Atoi(val)
+		if err != nil || priority < 1 {
+			return fmt.Errorf("invalid route priority \"%s\", must be a positive integer", val)
+		}
+		rule.Priority = priority
+	case "whitelist":
+		list := CommaSeparatedList{}
+		list.UnmarshalFlag(val)
+		rule.Whitelist = list
+	case "domains":
+		list := CommaSeparatedList{}
+		list.UnmarshalFlag(val)
+		rule.Domains = list
+	case "tier":
+		err := rule.Tier.UnmarshalFlag(val)
+		if err != nil {
+			return err
+		}
+	case "status":
+		status, err := strconv.Atoi(val)
+		if err != nil || status < 400 || status > 599 {
+			return fmt.Errorf("invalid route status \"%s\", must be between 400 and 599", val)
+		}
+		rule.Status = status
+	case "redirect":
+		rule.Redirect = val
+	case "template":
+		tmpl, err := template.ParseFiles(val)
+		if err != nil {
+			return fmt.Errorf("invalid route template: %v", err)
+		}
+		rule.Template = val
+		rule.template = tmpl
+	default:
+		return fmt.Errorf("invalid route param: %v", option)
+	}
+
+	return nil
+}
+
+func (c *Config) setAPIKeyParam(option, name, param, val string) error {
+	// Get or create api key
+	key, ok := c.APIKeys[name]
+	if !ok {
+		key = NewAPIKey(name)
+		c.APIKeys[name] = key
+	}
+
+	// Add param value to api key
+	var err error
+	switch param {
+	case "hash":
+		key.Hash, err = parseAPIKeyHash(val)
+	case "identity":
+		key.Identity = val
+	case "rules":
+		list := CommaSeparatedList{}
+		list.UnmarshalFlag(val)
+		key.Rules = list
+	case "tier":
+		err = key.Tier.UnmarshalFlag(val)
+	case "expires":
+		key.Expires, err = parseAPIKeyExpiry(val)
+	default:
+		err = fmt.Errorf("invalid api key param: %v", option)
+	}
+
+	return err
 }
 
 func handleFlagError(err error) error {
@@ -189,7 +454,8 @@ func handleFlagError(err error) error {
 	return err
 }
 
-var legacyFileFormat = regexp.MustCompile(`(?m)^([a-z-]+) (.*)$`)
+// Options in the "<option> <value>" format of traefik-forward-auth
+var legacyFileFormat = regexp.MustCompile(`(?m)^([a-z-]+) ([^=].*)$`)
 
 func convertLegacyToIni(name string) (io.Reader, error) {
 	b, err := ioutil.ReadFile(name)
@@ -202,18 +468,80 @@ func convertLegacyToIni(name string) (io.Reader, error) {
 
 // Validate validates a config object
 func (c *Config) Validate() {
+	c.logStateSecretCreated()
+	c.logRuleFileErrors()
+	c.logRuleEnvSkipped()
+	for _, err := range c.validate() {
+		log.Fatal(err)
+	}
+}
+
+// Check a config object for errors, returning all that are found
+func (c *Config) validate() []error {
+	var errs []error
+
 	// Check for show stopper errors
 	if len(c.Secret) == 0 {
-		log.Fatal("\"secret\" option must be set")
+		errs = append(errs, errors.New("\"secret\" option must be set"))
 	}
 
 	// Check rules (validates the rule and the rule provider)
-	for _, rule := range c.Rules {
+	usesTiers := c.MinTier != NoAccess
+	for _, name := range c.OrderedRules() {
+		rule := c.Rules[name]
 		err := rule.Validate()
 		if err != nil {
-			log.Fatal(err)
+			errs = append(errs, err)
+		}
+		err = rule.Compile()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid rule \"%s\": %v", name, err))
+		}
+		if rule.Tier != NoAccess {
+			usesTiers = true
+		}
+	}
+
+	// Check api keys are scoped to rules that exist
+	for name, key := range c.APIKeys {
+		err := key.Validate(name)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, rule := range key.Rules {
+			if _, ok := c.Rules[rule]; !ok && rule != "default" {
+				errs = append(errs, fmt.Errorf("api key \"%s\" is scoped to unknown rule \"%s\"", name, rule))
+			}
 		}
 	}
+
+	if len(c.JWTHeader) > 0 && len(c.JWTKeys) == 0 {
+		errs = append(errs, errors.New("\"jwt-key\" option must be set to use \"jwt-header\""))
+	}
+	if _, err := LoadJWTKeys(c.JWTKeys); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.SessionStore == "file" && len(c.SessionStorePath) == 0 {
+		errs = append(errs, errors.New("\"session-store-path\" option must be set to use the file session store"))
+	}
+
+	// Access tiers can only be resolved against a server
+	if usesTiers && len(c.ServerIdentifier) == 0 {
+		errs = append(errs, errors.New("\"server-identifier\" option must be set to use access tiers"))
+	}
+	if c.RecheckInterval > 0 && len(c.ServerIdentifier) == 0 {
+		errs = append(errs, errors.New("\"server-identifier\" option must be set to use \"recheck-interval\""))
+	}
+
+	if u, err := url.Parse(c.PlexURL); len(c.PlexURL) > 0 && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0) {
+		errs = append(errs, errors.New("\"plex-url\" option must be an http or https URL"))
+	}
+	if c.PlexRetries < 0 {
+		errs = append(errs, errors.New("\"plex-retries\" option must not be negative"))
+	}
+
+	return errs
 }
 
 func (c Config) String() string {
@@ -225,8 +553,14 @@ func (c Config) String() string {
 type Rule struct {
 	Action    string
 	Rule      string
+	Priority  int
 	Whitelist CommaSeparatedList
 	Domains   CommaSeparatedList
+	Tier      AccessTier
+	Status    int
+	Redirect  string
+	Template  string
+	template  *template.Template
 }
 
 // NewRule creates a new rule object
@@ -236,16 +570,64 @@ func NewRule() *Rule {
 	}
 }
 
+// EffectivePriority returns the priority of the rule, which defaults to the
+// length of the rule, as in traefik
+func (r *Rule) EffectivePriority() int {
+	if r.Priority > 0 {
+		return r.Priority
+	}
+
+	return len(r.Rule)
+}
+
+// OrderedRules returns the names of the rules in the order they are evaluated,
+// highest priority first with ties broken by name
+func (c *Config) OrderedRules() []string {
+	names := make([]string, 0, len(c.Rules))
+	for name := range c.Rules {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi := c.Rules[names[i]].EffectivePriority()
+		pj := c.Rules[names[j]].EffectivePriority()
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
 func (r *Rule) formattedRule() string {
 	// Traefik implements their own "Host" matcher and then offers "HostRegexp"
 	// to invoke the mux "Host" matcher. This ensures the mux version is used
 	return strings.ReplaceAll(r.Rule, "Host(", "HostRegexp(")
 }
 
+// Compile checks the rule can be parsed by traefik's rule parser
+func (r *Rule) Compile() error {
+	if len(r.Rule) == 0 {
+		return errors.New("rule is required")
+	}
+
+	m, err := muxhttp.NewMuxer()
+	if err != nil {
+		return err
+	}
+
+	return m.AddRoute(r.formattedRule(), 0, http.NotFoundHandler())
+}
+
 // Validate validates a rule
 func (r *Rule) Validate() error {
-	if r.Action != "auth" && r.Action != "allow" {
-		return errors.New("invalid rule action, must be \"auth\" or \"allow\"")
+	if r.Action != "auth" && r.Action != "allow" && r.Action != "deny" {
+		return errors.New("invalid rule action, must be \"auth\", \"allow\" or \"deny\"")
+	}
+
+	if len(r.Redirect) > 0 && len(r.Template) > 0 {
+		return errors.New("invalid rule, only one of \"redirect\" or \"template\" can be set")
 	}
 
 	return nil
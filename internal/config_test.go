@@ -3,6 +3,7 @@ package tfaps
 import (
 	// "fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -12,6 +13,13 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// Replace the global config for a test, as on startup
+func setTestConfig(args []string) error {
+	c, err := NewConfig(args)
+	setConfig(c)
+	return err
+}
+
 /**
  * Tests
  */
@@ -37,6 +45,9 @@ func TestConfigDefaults(t *testing.T) {
 	assert.Equal("/_oauth", c.Path)
 	assert.Len(c.Whitelist, 0)
 	assert.Equal(c.Port, 4181)
+	assert.Equal(NoAccess, c.MinTier)
+	assert.Equal(time.Duration(0), c.RecheckInterval)
+	assert.Equal(time.Hour, c.RecheckGrace)
 }
 
 func TestConfigParseArgs(t *testing.T) {
@@ -48,7 +59,9 @@ func TestConfigParseArgs(t *testing.T) {
 		"--rule.1.rule=PathPrefix(`/one`)",
 		"--rule.two.action=auth",
 		"--rule.two.rule=\"Host(`two.com`) && Path(`/two`)\"",
+		"--rule.two.tier=home",
 		"--port=8000",
+		"--min-tier=friend",
 	})
 	require.Nil(t, err)
 
@@ -56,6 +69,7 @@ func TestConfigParseArgs(t *testing.T) {
 	assert.Equal("cookiename", c.CookieName)
 	assert.Equal("csrfcookiename", c.CSRFCookieName)
 	assert.Equal(8000, c.Port)
+	assert.Equal(NormalUser, c.MinTier)
 
 	// Check rules
 	assert.Equal(map[string]*Rule{
@@ -66,6 +80,7 @@ func TestConfigParseArgs(t *testing.T) {
 		"two": {
 			Action: "auth",
 			Rule:   "Host(`two.com`) && Path(`/two`)",
+			Tier:   HomeUser,
 		},
 	}, c.Rules)
 }
@@ -99,6 +114,71 @@ func TestConfigParseRuleError(t *testing.T) {
 	}
 	// Check rules
 	assert.Equal(map[string]*Rule{}, c.Rules)
+
+	// Rule with invalid status
+	_, err = NewConfig([]string{
+		"--rule.one.status=200",
+	})
+	if assert.Error(err) {
+		assert.Equal("invalid route status \"200\", must be between 400 and 599", err.Error())
+	}
+
+	// Rule with missing template
+	_, err = NewConfig([]string{
+		"--rule.one.template=/missing.html",
+	})
+	assert.Error(err)
+
+	// Rule with invalid tier
+	_, err = NewConfig([]string{
+		"--rule.one.tier=admin",
+	})
+	if assert.Error(err) {
+		assert.Equal("invalid access tier \"admin\", must be \"owner\", \"home\" or \"friend\"", err.Error())
+	}
+}
+
+func TestConfigParseAPIKeys(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--api-key.ci.hash=" + HashAPIKey("secret"),
+		"--api-key.ci.rules=one,two",
+		"--api-key.ci.expires=2030-01-02",
+		"--api-key.monitor.hash", "\"" + HashAPIKey("other") + "\"",
+		"--api-key.monitor.identity=uptime@example.com",
+		"--api-key.monitor.tier=friend",
+	})
+	require.Nil(t, err)
+
+	if assert.Contains(c.APIKeys, "ci") {
+		key := c.APIKeys["ci"]
+		assert.Equal("ci@api-key", key.Identity, "identity should default to key name")
+		assert.Equal(CommaSeparatedList{"one", "two"}, key.Rules)
+		assert.Equal(time.Date(2030, 1, 3, 0, 0, 0, 0, time.UTC), key.Expires, "date should expire at end of day")
+		assert.Len(key.Hash, 32)
+	}
+	if assert.Contains(c.APIKeys, "monitor") {
+		key := c.APIKeys["monitor"]
+		assert.Equal("uptime@example.com", key.Identity)
+		assert.Equal(NormalUser, key.Tier)
+		assert.True(key.Expires.IsZero())
+	}
+
+	// Should require a hash in the expected format
+	_, err = NewConfig([]string{"--api-key.ci.hash=secret"})
+	if assert.Error(err) {
+		assert.Equal("invalid api key hash, must be in the format \"sha256:<hex>\"", err.Error())
+	}
+
+	// Should require a valid expiry
+	_, err = NewConfig([]string{"--api-key.ci.expires=tomorrow"})
+	assert.Error(err)
+
+	// Should reject unknown params
+	_, err = NewConfig([]string{"--api-key.ci.bad=value"})
+	if assert.Error(err) {
+		assert.Equal("invalid api key param: api-key.ci.bad", err.Error())
+	}
 }
 
 func TestConfigParseIni(t *testing.T) {
@@ -125,6 +205,55 @@ func TestConfigParseIni(t *testing.T) {
 	}, c.Rules)
 }
 
+func TestConfigParseStructured(t *testing.T) {
+	for _, file := range []string{"config.yaml", "config.json", "config.toml"} {
+		t.Run(file, func(t *testing.T) {
+			assert := assert.New(t)
+			c, err := NewConfig([]string{
+				"--config=../test/" + file,
+				"--lifetime=60",
+			})
+			require.Nil(t, err)
+
+			assert.Equal("structuredcookiename", c.CookieName, "should be read from file")
+			assert.Equal("/structured", c.Path, "should be read from file")
+			assert.True(c.InsecureCookie, "bool should be read from file")
+			assert.Equal(60, c.LifetimeString, "flag should override file")
+			assert.Equal(CommaSeparatedList{"alice@example.com", "bob@example.com"}, c.Whitelist, "list should be read from file")
+			assert.Equal(map[string]*Rule{
+				"public": {
+					Action: "allow",
+					Rule:   "PathPrefix(`/public`)",
+				},
+				"admin": {
+					Action:    "auth",
+					Rule:      "Host(`admin.com`)",
+					Whitelist: CommaSeparatedList{"alice@example.com", "carol@example.com"},
+					Tier:      Owner,
+				},
+			}, c.Rules)
+		})
+	}
+
+	// Should report errors with the file
+	path := filepath.Join(t.TempDir(), "bad.yaml")
+	os.WriteFile(path, []byte("rules: [one, two]\n"), 0600)
+	_, err := NewConfig([]string{"--config=" + path})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "unable to parse "+path+": \"rules\" must be a mapping of names to params")
+	}
+}
+
+func TestConfigParseLegacy(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{"--config=../test/config-legacy"})
+	require.Nil(t, err)
+
+	assert.Equal("legacycookiename", c.CookieName, "should be read from legacy file")
+	assert.Equal("/legacy", c.Path, "should be read from legacy file")
+	assert.Equal(3600, c.LifetimeString, "ini options should still be read")
+}
+
 func TestConfigParseEnvironment(t *testing.T) {
 	assert := assert.New(t)
 	os.Setenv("COOKIE_NAME", "env_cookie_name")
@@ -149,6 +278,66 @@ func TestConfigParseEnvironment(t *testing.T) {
 	os.Unsetenv("WHITELIST")
 }
 
+func TestConfigParseRuleEnvironment(t *testing.T) {
+	assert := assert.New(t)
+	os.Setenv("RULE_ONE_ACTION", "allow")
+	os.Setenv("RULE_ONE_RULE", "\"PathPrefix(`/one`)\"")
+	os.Setenv("RULE_TWO_RULE", "Host(`env.com`)")
+	os.Setenv("RULE_TWO_WHITELIST", "a@env.com,b@env.com")
+	os.Setenv("RULE_MY_APP_PRIORITY", "10")
+	defer func() {
+		os.Unsetenv("RULE_ONE_ACTION")
+		os.Unsetenv("RULE_ONE_RULE")
+		os.Unsetenv("RULE_TWO_RULE")
+		os.Unsetenv("RULE_TWO_WHITELIST")
+		os.Unsetenv("RULE_MY_APP_PRIORITY")
+	}()
+
+	// Environment should override files, but not flags
+	c, err := NewConfig([]string{
+		"--config=../test/config1",
+		"--rule.two.whitelist=flag@example.com",
+	})
+	require.Nil(t, err)
+	assert.Equal(map[string]*Rule{
+		"one": {
+			Action: "allow",
+			Rule:   "PathPrefix(`/one`)",
+		},
+		"two": {
+			Action:    "auth",
+			Rule:      "Host(`env.com`)",
+			Whitelist: CommaSeparatedList{"flag@example.com"},
+		},
+		"my_app": {
+			Action:   "auth",
+			Priority: 10,
+		},
+	}, c.Rules)
+
+	// Should skip variables that aren't rule params
+	os.Setenv("RULE_X", "x")
+	os.Setenv("RULE_ACTION", "allow")
+	os.Setenv("RULE_ENGINE_URL", "http://rules.example.com")
+	defer func() {
+		os.Unsetenv("RULE_X")
+		os.Unsetenv("RULE_ACTION")
+		os.Unsetenv("RULE_ENGINE_URL")
+	}()
+	c, err = NewConfig([]string{})
+	require.Nil(t, err)
+	assert.Equal([]string{"RULE_ACTION", "RULE_ENGINE_URL", "RULE_X"}, c.ruleEnvSkipped)
+	assert.NotContains(c.Rules, "engine")
+
+	// Should still report invalid values
+	os.Setenv("RULE_ONE_PRIORITY", "x")
+	defer os.Unsetenv("RULE_ONE_PRIORITY")
+	_, err = NewConfig([]string{})
+	if assert.NotNil(err) {
+		assert.Equal("invalid route priority \"x\", must be a positive integer", err.Error())
+	}
+}
+
 func TestConfigTransformation(t *testing.T) {
 	assert := assert.New(t)
 	c, err := NewConfig([]string{
@@ -178,6 +367,7 @@ func TestConfigValidate(t *testing.T) {
 	// Validate default config + rule error
 	c, _ := NewConfig([]string{
 		"--rule.1.action=bad",
+		"--rule.1.rule=Path(`/`)",
 	})
 	c.Validate()
 
@@ -189,7 +379,7 @@ func TestConfigValidate(t *testing.T) {
 	assert.Equal(logrus.FatalLevel, logs[0].Level)
 
 	// Should validate rule
-	assert.Equal("invalid rule action, must be \"auth\" or \"allow\"", logs[1].Message)
+	assert.Equal("invalid rule action, must be \"auth\", \"allow\" or \"deny\"", logs[1].Message)
 	assert.Equal(logrus.FatalLevel, logs[1].Level)
 
 	hook.Reset()
@@ -198,12 +388,148 @@ func TestConfigValidate(t *testing.T) {
 	c, _ = NewConfig([]string{
 		"--secret=veryverysecret",
 		"--rule.1.action=auth",
+		"--rule.1.rule=Path(`/`)",
 		"--rule.1.provider=bad2",
 	})
 	c.Validate()
 
 	logs = hook.AllEntries()
 	assert.Len(logs, 1)
+
+	hook.Reset()
+
+	// Validate rule expressions
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--rule.typo.rule=PathPrefx(`/admin`)",
+		"--rule.missing.action=allow",
+	})
+	c.Validate()
+
+	logs = hook.AllEntries()
+	if assert.Len(logs, 2) {
+		assert.Equal("invalid rule \"typo\": error while parsing rule PathPrefx(`/admin`): unsupported function: PathPrefx", logs[0].Message)
+		assert.Equal("invalid rule \"missing\": rule is required", logs[1].Message)
+	}
+
+	hook.Reset()
+
+	// Validate access tier without server identifier
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--rule.1.rule=Path(`/`)",
+		"--rule.1.tier=owner",
+	})
+	c.Validate()
+
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("\"server-identifier\" option must be set to use access tiers", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--server-identifier=abc",
+		"--min-tier=home",
+	})
+	c.Validate()
+	assert.Len(hook.AllEntries(), 0)
+
+	// Validate recheck without server identifier
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--recheck-interval=60",
+	})
+	c.Validate()
+
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("\"server-identifier\" option must be set to use \"recheck-interval\"", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	// Validate jwt header without key
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--jwt-header=X-Forwarded-Jwt",
+	})
+	c.Validate()
+
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("\"jwt-key\" option must be set to use \"jwt-header\"", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	// Validate api key without hash or rules
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--api-key.ci.identity=ci@example.com",
+	})
+	c.Validate()
+
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("api key \"ci\" must have a \"hash\"", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--api-key.ci.hash=" + HashAPIKey("secret"),
+	})
+	c.Validate()
+
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("api key \"ci\" must be scoped to at least one rule with \"rules\"", logs[0].Message)
+	}
+
+	hook.Reset()
+
+	// Validate api key scoped to unknown rule
+	c, _ = NewConfig([]string{
+		"--secret=veryverysecret",
+		"--api-key.ci.hash=" + HashAPIKey("secret"),
+		"--api-key.ci.rules=default,missing",
+	})
+	c.Validate()
+
+	logs = hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal("api key \"ci\" is scoped to unknown rule \"missing\"", logs[0].Message)
+	}
+}
+
+func TestConfigOrderedRules(t *testing.T) {
+	assert := assert.New(t)
+	c, err := NewConfig([]string{
+		"--rule.b.rule=Path(`/b`)",
+		"--rule.a.rule=Path(`/a`)",
+		"--rule.long.rule=PathPrefix(`/long`)",
+		"--rule.first.rule=Path(`/first`)",
+		"--rule.first.priority=100",
+		"--rule.last.rule=PathPrefix(`/last`)",
+		"--rule.last.priority=1",
+	})
+	require.Nil(t, err)
+
+	assert.Equal(100, c.Rules["first"].EffectivePriority())
+	assert.Equal(len("Path(`/a`)"), c.Rules["a"].EffectivePriority(), "priority should default to rule length")
+	assert.Equal([]string{"first", "long", "a", "b", "last"}, c.OrderedRules(), "ties should be broken by name")
+
+	// Should require a positive priority
+	_, err = NewConfig([]string{"--rule.a.priority=high"})
+	if assert.Error(err) {
+		assert.Equal("invalid route priority \"high\", must be a positive integer", err.Error())
+	}
+	_, err = NewConfig([]string{"--rule.a.priority=0"})
+	assert.Error(err)
 }
 
 func TestConfigCommaSeparatedList(t *testing.T) {
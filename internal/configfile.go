@@ -0,0 +1,162 @@
+package tfaps
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/thomseddon/go-flags"
+	"gopkg.in/yaml.v3"
+)
+
+// Sections of structured config files that hold named definitions, and the
+// prefix of their options
+var configFileSections = map[string]string{
+	"rules":    "rule",
+	"api-keys": "api-key",
+}
+
+// Parse a config file into the options. Structured formats are converted to
+// ini, so options are set in the same way as from ini files
+func parseConfigFile(i *flags.IniParser, path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json", ".toml":
+		r, err := convertStructuredToIni(path)
+		if err != nil {
+			return fmt.Errorf("unable to parse %s: %v", path, err)
+		}
+		return i.Parse(r)
+	}
+
+	err := i.ParseFile(path)
+
+	// Fall back to the "<option> <value>" format of traefik-forward-auth
+	var iniErr *flags.IniError
+	if errors.As(err, &iniErr) && strings.Contains(iniErr.Message, "malformed key=value") {
+		r, err := convertLegacyToIni(path)
+		if err != nil {
+			return err
+		}
+		return i.Parse(r)
+	}
+
+	return err
+}
+
+// Convert a yaml, json or toml config file to ini. Lists become repeated
+// options, and the "rules" and "api-keys" sections become "rule.<name>.<param>"
+// and "api-key.<name>.<param>" options
+func convertStructuredToIni(path string) (io.Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		err = d.Decode(&doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		err = yaml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ini bytes.Buffer
+	for _, key := range sortedKeys(doc) {
+		prefix, isSection := configFileSections[key]
+		if !isSection {
+			err = writeIniOption(&ini, key, doc[key], true)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		names, ok := doc[key].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("\"%s\" must be a mapping of names to params", key)
+		}
+		for _, name := range sortedKeys(names) {
+			params, ok := names[name].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("\"%s.%s\" must be a mapping of params", key, name)
+			}
+			for _, param := range sortedKeys(params) {
+				// Rule and api key lists are comma separated
+				option := fmt.Sprintf("%s.%s.%s", prefix, name, param)
+				err = writeIniOption(&ini, option, params[param], false)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return &ini, nil
+}
+
+func writeIniOption(w io.Writer, option string, val interface{}, repeat bool) error {
+	switch val := val.(type) {
+	case []interface{}:
+		items := make([]string, len(val))
+		for i, item := range val {
+			if _, ok := item.(map[string]interface{}); ok {
+				return fmt.Errorf("invalid option \"%s\", lists can only contain values", option)
+			}
+			items[i] = iniValue(item)
+		}
+		if !repeat {
+			fmt.Fprintf(w, "%s = %s\n", option, strconv.Quote(strings.Join(items, ",")))
+			return nil
+		}
+		for _, item := range items {
+			fmt.Fprintf(w, "%s = %s\n", option, strconv.Quote(item))
+		}
+	case map[string]interface{}, []map[string]interface{}:
+		return fmt.Errorf("invalid option \"%s\", must be a value or list", option)
+	case nil:
+		fmt.Fprintf(w, "%s =\n", option)
+	default:
+		fmt.Fprintf(w, "%s = %s\n", option, strconv.Quote(iniValue(val)))
+	}
+
+	return nil
+}
+
+// Format a value as an option would be given on the command line, times are
+// formatted so they can be used for an api key's "expires"
+func iniValue(val interface{}) string {
+	t, ok := val.(time.Time)
+	if !ok {
+		return fmt.Sprint(val)
+	}
+	// toml decodes local dates, such as 2027-01-01, into this zone
+	if t.Location().String() == "date-local" {
+		return t.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
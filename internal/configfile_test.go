@@ -0,0 +1,102 @@
+package tfaps
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestConfigFileConvertStructuredToIni(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+domain: [example.com, test.com]
+secret: "has \"quotes\""
+api-keys:
+  ci:
+    hash: sha256:abc
+    rules: [one, two]
+`), 0600)
+	require.Nil(err)
+
+	r, err := convertStructuredToIni(path)
+	require.Nil(err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(`api-key.ci.hash = "sha256:abc"
+api-key.ci.rules = "one,two"
+domain = "example.com"
+domain = "test.com"
+secret = "has \"quotes\""
+`, string(b))
+
+	// Nested options other than rules and api keys are invalid
+	os.WriteFile(path, []byte("whitelist:\n  nested: true\n"), 0600)
+	_, err = convertStructuredToIni(path)
+	if assert.NotNil(err) {
+		assert.Equal("invalid option \"whitelist\", must be a value or list", err.Error())
+	}
+}
+
+func TestConfigFileConvertTOMLToIni(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte(`
+# Comment
+a = "one # not a comment \u00e9"
+b = 'C:\path'
+c = ["[x", 'y]'] # Comment
+d = """
+multi"""
+e = 1.5
+rules.one.action = "allow"
+rules.three = { action = "auth", rule = "Host(`+"`a`"+`)" }
+
+[rules."two"]
+rule = "Path(`+"`/`"+`)"
+
+[api-keys.ci]
+expires = 2027-01-01
+`), 0600)
+	require.Nil(err)
+
+	r, err := convertStructuredToIni(path)
+	require.Nil(err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(`a = "one # not a comment é"
+api-key.ci.expires = "2027-01-01"
+b = "C:\\path"
+c = "[x"
+c = "y]"
+d = "multi"
+e = "1.5"
+rule.one.action = "allow"
+rule.three.action = "auth"
+rule.three.rule = "Host(`+"`a`"+`)"
+rule.two.rule = "Path(`+"`/`"+`)"
+`, string(b))
+
+	tests := []string{
+		"a = 1\na = 2",
+		"a = \"unfinished",
+		"a = [1, 2",
+		"a = maybe",
+		"[[whitelist]]\nname = \"a\"",
+	}
+	for _, input := range tests {
+		os.WriteFile(path, []byte(input), 0600)
+		_, err := convertStructuredToIni(path)
+		assert.NotNil(err, input)
+	}
+}
@@ -0,0 +1,308 @@
+package tfaps
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Header used to pass the matched route back from the explain muxer
+const explainRouteHeader = "X-Explain-Route"
+
+// Outcomes of evaluating a request
+const (
+	OutcomeAllow    = "allow"
+	OutcomeLogin    = "login"
+	OutcomeDeny     = "deny"
+	OutcomeEndpoint = "endpoint"
+)
+
+// ExplainCase holds a simulated request to evaluate against the rules, as read
+// from the command line or a batch file
+type ExplainCase struct {
+	Name    string            `json:"name,omitempty"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	User    string            `json:"user,omitempty"`
+	Tier    string            `json:"tier,omitempty"`
+	Expect  string            `json:"expect,omitempty"`
+}
+
+// Explanation holds the result of evaluating an ExplainCase
+type Explanation struct {
+	Rule      string
+	Action    string
+	Priority  int
+	Endpoint  string
+	ListScope string
+	Whitelist CommaSeparatedList
+	Domains   CommaSeparatedList
+	Tier      AccessTier
+	Outcome   string
+	Reason    string
+}
+
+// ExplainOptions holds the options of the "explain" command
+type ExplainOptions struct {
+	File  string
+	Case  ExplainCase
+	Extra []string
+}
+
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return ""
+}
+
+func (h headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid header \"%s\", must be in the format \"<name>: <value>\"", value)
+	}
+	h[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// ParseExplainArgs parses the options of the "explain" command, returning the
+// remaining args to be parsed as config
+func ParseExplainArgs(args []string) (*ExplainOptions, error) {
+	o := &ExplainOptions{
+		Case: ExplainCase{Headers: map[string]string{}},
+	}
+
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage:\n  traefik-forward-auth explain [EXPLAIN OPTIONS] -- [OPTIONS]\n\nExplain Options:")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.Case.Method, "method", "GET", "Request method")
+	fs.StringVar(&o.Case.URL, "url", "", "Request URL, e.g. https://app.example.com/admin")
+	fs.Var(headerFlags(o.Case.Headers), "header", "Request header in the format \"<name>: <value>\", can be set multiple times")
+	fs.StringVar(&o.Case.User, "user", "", "Email address of the user making the request, if logged in")
+	fs.StringVar(&o.Case.Tier, "tier", "", "Access tier of the user, can be \"owner\", \"home\" or \"friend\"")
+	fs.StringVar(&o.File, "file", "", "JSON file of test cases to evaluate instead of a single request")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.File) == 0 && len(o.Case.URL) == 0 {
+		fs.Usage()
+		return nil, errors.New("\"url\" or \"file\" option must be set")
+	}
+	o.Extra = fs.Args()
+
+	return o, nil
+}
+
+// Explain evaluates the cases given by the options against the rules, writing
+// an explanation of each. It returns false if any case in a batch file didn't
+// have the expected outcome
+func Explain(o *ExplainOptions, out io.Writer) (bool, error) {
+	cases := []ExplainCase{o.Case}
+	if len(o.File) > 0 {
+		b, err := os.ReadFile(o.File)
+		if err != nil {
+			return false, err
+		}
+		cases = nil
+		err = json.Unmarshal(b, &cases)
+		if err != nil {
+			return false, fmt.Errorf("unable to parse %s: %v", o.File, err)
+		}
+	}
+
+	s := &Server{}
+	passed := 0
+	for i, c := range cases {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+
+		e, err := s.Explain(c)
+		if err != nil {
+			return false, err
+		}
+		writeExplanation(out, c, e)
+
+		if len(c.Expect) > 0 {
+			if c.Expect == e.Outcome {
+				passed++
+				fmt.Fprintln(out, "Result:    PASS")
+			} else {
+				fmt.Fprintf(out, "Result:    FAIL, expected %s\n", c.Expect)
+			}
+		} else {
+			passed++
+		}
+	}
+
+	if len(o.File) > 0 {
+		fmt.Fprintf(out, "\n%d passed, %d failed\n", passed, len(cases)-passed)
+	}
+
+	return passed == len(cases), nil
+}
+
+// Explain evaluates a simulated request against the rules, using the same
+// muxer and user validation as requests to the server
+func (s *Server) Explain(c ExplainCase) (Explanation, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || len(u.Host) == 0 {
+		return Explanation{}, fmt.Errorf("invalid url \"%s\"", c.URL)
+	}
+
+	cfg := currentConfig()
+	muxer, err := s.newMuxer(cfg, func(c *Config, name, action string) http.Handler {
+		return explainHandler("rule:" + name)
+	}, func(name string, h http.Handler) http.Handler {
+		return explainHandler("endpoint:" + name)
+	})
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	// Build the request as traefik would forward it
+	method := c.Method
+	if len(method) == 0 {
+		method = "GET"
+	}
+	r := httptest.NewRequest(method, "/", nil)
+	for name, value := range c.Headers {
+		r.Header.Set(name, value)
+	}
+	r.Header.Set("X-Forwarded-Method", method)
+	r.Header.Set("X-Forwarded-Proto", u.Scheme)
+	r.Header.Set("X-Forwarded-Host", u.Host)
+	r.Header.Set("X-Forwarded-Uri", u.RequestURI())
+
+	w := httptest.NewRecorder()
+	explainer := &Server{muxer: muxer}
+	explainer.RootHandler(w, r)
+	route := w.Header().Get(explainRouteHeader)
+
+	e := Explanation{}
+	if name := strings.TrimPrefix(route, "endpoint:"); name != route {
+		e.Endpoint = name
+		e.Outcome = OutcomeEndpoint
+		e.Reason = "handled by forward auth"
+		return e, nil
+	}
+
+	e.Rule = strings.TrimPrefix(route, "rule:")
+	e.Action = cfg.DefaultAction
+	if rule, ok := cfg.Rules[e.Rule]; ok {
+		e.Action = rule.Action
+		e.Priority = rule.EffectivePriority()
+	}
+
+	if e.Action == "allow" {
+		e.Outcome = OutcomeAllow
+		e.Reason = "rule allows all requests"
+		return e, nil
+	}
+	if e.Action == "deny" {
+		e.Outcome = OutcomeDeny
+		e.Reason = "rule denies all requests"
+		return e, nil
+	}
+
+	// Work out which lists apply, as in ValidateEmail
+	e.ListScope = "global"
+	e.Whitelist = cfg.Whitelist
+	e.Domains = cfg.Domains
+	if rule, ok := cfg.Rules[e.Rule]; ok && (len(rule.Whitelist) > 0 || len(rule.Domains) > 0) {
+		e.ListScope = "rule"
+		e.Whitelist = rule.Whitelist
+		e.Domains = rule.Domains
+	}
+	e.Tier = requiredAccessTier(cfg, e.Rule)
+
+	var tier AccessTier
+	err = tier.UnmarshalFlag(c.Tier)
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	switch {
+	case len(c.User) == 0:
+		e.Outcome = OutcomeLogin
+		e.Reason = "no user, refused with 401"
+		if isNavigation(r) {
+			e.Reason = "no user, shown sign in page with 401"
+		}
+	case !ValidateEmail(cfg, c.User, e.Rule):
+		e.Outcome = OutcomeDeny
+		e.Reason = "user not permitted by whitelist or domains"
+	case !ValidateAccessTier(cfg, tier, e.Rule):
+		e.Outcome = OutcomeDeny
+		e.Reason = "insufficient access tier"
+	default:
+		e.Outcome = OutcomeAllow
+		e.Reason = "user permitted"
+	}
+
+	return e, nil
+}
+
+func explainHandler(route string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(explainRouteHeader, route)
+	}
+}
+
+func writeExplanation(out io.Writer, c ExplainCase, e Explanation) {
+	if len(c.Name) > 0 {
+		fmt.Fprintf(out, "Case:      %s\n", c.Name)
+	}
+	method := c.Method
+	if len(method) == 0 {
+		method = "GET"
+	}
+	fmt.Fprintf(out, "Request:   %s %s\n", method, c.URL)
+	if len(c.User) > 0 {
+		tier := c.Tier
+		if len(tier) == 0 {
+			tier = "none"
+		}
+		fmt.Fprintf(out, "User:      %s (tier: %s)\n", c.User, tier)
+	}
+
+	if len(e.Endpoint) > 0 {
+		fmt.Fprintf(out, "Endpoint:  %s\n", e.Endpoint)
+	} else {
+		if e.Rule == "default" {
+			fmt.Fprintln(out, "Rule:      default (no rule matched)")
+		} else {
+			fmt.Fprintf(out, "Rule:      %s (priority %d)\n", e.Rule, e.Priority)
+		}
+		fmt.Fprintf(out, "Action:    %s\n", e.Action)
+	}
+
+	if e.Action == "auth" {
+		fmt.Fprintf(out, "Whitelist: %s\n", explainList(e.ListScope, e.Whitelist))
+		fmt.Fprintf(out, "Domains:   %s\n", explainList(e.ListScope, e.Domains))
+		if e.Tier != NoAccess {
+			tier, _ := e.Tier.MarshalFlag()
+			fmt.Fprintf(out, "Tier:      %s or above\n", tier)
+		}
+	}
+
+	fmt.Fprintf(out, "Outcome:   %s (%s)\n", e.Outcome, e.Reason)
+}
+
+func explainList(scope string, list CommaSeparatedList) string {
+	if len(list) == 0 {
+		return fmt.Sprintf("none (%s)", scope)
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(list, ", "), scope)
+}
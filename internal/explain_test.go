@@ -0,0 +1,143 @@
+package tfaps
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestExplainParseExplainArgs(t *testing.T) {
+	assert := assert.New(t)
+
+	o, err := ParseExplainArgs([]string{
+		"-method", "POST",
+		"-url", "https://app.example.com/admin",
+		"-header", "X-Api: 1",
+		"-user", "jane@example.com",
+		"-tier", "home",
+		"--", "--config=test.ini",
+	})
+	require.Nil(t, err)
+	assert.Equal(ExplainCase{
+		Method:  "POST",
+		URL:     "https://app.example.com/admin",
+		Headers: map[string]string{"X-Api": "1"},
+		User:    "jane@example.com",
+		Tier:    "home",
+	}, o.Case)
+	assert.Equal([]string{"--config=test.ini"}, o.Extra, "remaining args should be config")
+
+	// Should require a url or file
+	_, err = ParseExplainArgs([]string{"-user", "jane@example.com"})
+	assert.Error(err)
+}
+
+func TestExplainExplain(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{
+		"--domain=example.com",
+		"--rule.public.action=allow",
+		"--rule.public.rule=Host(`app.example.com`) && PathPrefix(`/public`)",
+		"--rule.admin.rule=Host(`app.example.com`) && PathPrefix(`/admin`)",
+		"--rule.admin.whitelist=jane@example.com",
+		"--rule.admin.tier=owner",
+		"--rule.api.rule=Headers(`X-Api`, `1`)",
+		"--rule.blocked.action=deny",
+		"--rule.blocked.rule=PathPrefix(`/blocked`)",
+	})
+	s := &Server{}
+
+	// Should match allow rule
+	e, err := s.Explain(ExplainCase{URL: "https://app.example.com/public/page"})
+	require.Nil(t, err)
+	assert.Equal("public", e.Rule)
+	assert.Equal(OutcomeAllow, e.Outcome)
+
+	// Should match deny rule
+	e, err = s.Explain(ExplainCase{URL: "https://app.example.com/blocked", User: "jane@example.com"})
+	require.Nil(t, err)
+	assert.Equal("blocked", e.Rule)
+	assert.Equal(OutcomeDeny, e.Outcome)
+
+	// Should require login without user
+	e, err = s.Explain(ExplainCase{URL: "https://app.example.com/admin"})
+	require.Nil(t, err)
+	assert.Equal("admin", e.Rule)
+	assert.Equal(OutcomeLogin, e.Outcome)
+	assert.Equal("no user, refused with 401", e.Reason)
+
+	// Should show browsers the sign in page
+	e, err = s.Explain(ExplainCase{URL: "https://app.example.com/admin", Headers: map[string]string{"Sec-Fetch-Mode": "navigate"}})
+	require.Nil(t, err)
+	assert.Equal(OutcomeLogin, e.Outcome)
+	assert.Equal("no user, shown sign in page with 401", e.Reason)
+
+	// Should apply rule whitelist
+	e, err = s.Explain(ExplainCase{URL: "https://app.example.com/admin", User: "bob@example.com", Tier: "owner"})
+	require.Nil(t, err)
+	assert.Equal("rule", e.ListScope)
+	assert.Equal(CommaSeparatedList{"jane@example.com"}, e.Whitelist)
+	assert.Equal(OutcomeDeny, e.Outcome)
+
+	// Should apply rule tier
+	e, err = s.Explain(ExplainCase{URL: "https://app.example.com/admin", User: "jane@example.com", Tier: "home"})
+	require.Nil(t, err)
+	assert.Equal(Owner, e.Tier)
+	assert.Equal(OutcomeDeny, e.Outcome)
+	e, err = s.Explain(ExplainCase{URL: "https://app.example.com/admin", User: "jane@example.com", Tier: "owner"})
+	require.Nil(t, err)
+	assert.Equal(OutcomeAllow, e.Outcome)
+
+	// Should match on headers
+	e, err = s.Explain(ExplainCase{URL: "https://other.example.com/", Headers: map[string]string{"X-Api": "1"}, User: "bob@example.com"})
+	require.Nil(t, err)
+	assert.Equal("api", e.Rule)
+	assert.Equal("global", e.ListScope)
+	assert.Equal(OutcomeAllow, e.Outcome)
+
+	// Should fall through to default rule
+	e, err = s.Explain(ExplainCase{URL: "https://other.example.com/", User: "bob@other.com"})
+	require.Nil(t, err)
+	assert.Equal("default", e.Rule)
+	assert.Equal(OutcomeDeny, e.Outcome)
+
+	// Should identify our own endpoints
+	e, err = s.Explain(ExplainCase{URL: "https://app.example.com/_oauth/logout"})
+	require.Nil(t, err)
+	assert.Equal("logout", e.Endpoint)
+	assert.Equal(OutcomeEndpoint, e.Outcome)
+
+	// Should require an absolute url
+	_, err = s.Explain(ExplainCase{URL: "/admin"})
+	assert.Error(err)
+}
+
+func TestExplainBatch(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{
+		"--rule.public.action=allow",
+		"--rule.public.rule=PathPrefix(`/public`)",
+	})
+
+	file := filepath.Join(t.TempDir(), "cases.json")
+	require.Nil(t, os.WriteFile(file, []byte(`[
+		{"name": "public", "url": "https://app.example.com/public", "expect": "allow"},
+		{"name": "private", "url": "https://app.example.com/private", "expect": "allow"}
+	]`), 0600))
+
+	var out bytes.Buffer
+	ok, err := Explain(&ExplainOptions{File: file}, &out)
+	require.Nil(t, err)
+	assert.False(ok, "should fail if a case has an unexpected outcome")
+	assert.Contains(out.String(), "Case:      public\nRequest:   GET https://app.example.com/public\nRule:      public (priority 21)\nAction:    allow\nOutcome:   allow (rule allows all requests)\nResult:    PASS\n")
+	assert.Contains(out.String(), "Result:    FAIL, expected allow\n")
+	assert.Contains(out.String(), "1 passed, 1 failed\n")
+}
@@ -0,0 +1,546 @@
+// Package fakeplex is a stand-in for plex.tv, for running the login flow
+// without Plex accounts or internet access. It implements the parts of the
+// Plex API used to log users in, for a scripted set of users, and a login page
+// that claims the PIN for one of them. Claiming a PIN authorizes the client
+// that created it as one of the user's devices, and removing the device
+// revokes the user's token until they log in again.
+package fakeplex
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture The users the fake Plex knows about
+type Fixture struct {
+	Users []User `yaml:"users" json:"users"`
+}
+
+// User A Plex user, and their access to servers
+type User struct {
+	Id         int64  `yaml:"id" json:"id"`
+	UUID       string `yaml:"uuid" json:"uuid"`
+	Username   string `yaml:"username" json:"username"`
+	Title      string `yaml:"title" json:"title"`
+	Email      string `yaml:"email" json:"email"`
+	Thumb      string `yaml:"thumb" json:"thumb"`
+	Home       bool   `yaml:"home" json:"home"`
+	Restricted bool   `yaml:"restricted" json:"restricted"`
+
+	// Plex Pass plan, such as "lifetime", if the user has a subscription
+	Plan string `yaml:"plan" json:"plan"`
+
+	// Token the user is issued on login, which can also be used directly by
+	// API clients
+	Token string `yaml:"token" json:"token"`
+
+	// Access tier on each server the user is a member of, keyed by server
+	// identifier. Can be "owner", "home" or "friend"
+	Servers map[string]string `yaml:"servers" json:"servers"`
+}
+
+// LoadFixture loads a yaml or json fixture file
+func LoadFixture(path string) (*Fixture, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Fixture{}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(b, f)
+	} else {
+		err = yaml.Unmarshal(b, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	err = f.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+
+	return f, nil
+}
+
+// Validate checks users can be told apart, and have valid tiers
+func (f *Fixture) Validate() error {
+	usernames := map[string]bool{}
+	tokens := map[string]bool{}
+	for i, user := range f.Users {
+		if len(user.Username) == 0 || len(user.Email) == 0 || len(user.Token) == 0 {
+			return fmt.Errorf("user %d must have a username, email and token", i+1)
+		}
+		if usernames[user.Username] {
+			return fmt.Errorf("duplicate username \"%s\"", user.Username)
+		}
+		if tokens[user.Token] {
+			return fmt.Errorf("duplicate token for user \"%s\"", user.Username)
+		}
+		usernames[user.Username] = true
+		tokens[user.Token] = true
+
+		for server, tier := range user.Servers {
+			switch tier {
+			case "owner", "home", "friend":
+			default:
+				return fmt.Errorf("invalid tier \"%s\" for user \"%s\" on server \"%s\", must be \"owner\", \"home\" or \"friend\"", tier, user.Username, server)
+			}
+		}
+	}
+
+	return nil
+}
+
+type pin struct {
+	id               int
+	code             string
+	clientIdentifier string
+	token            string
+}
+
+// A client a user has logged in to
+type authorizedDevice struct {
+	id               int
+	clientIdentifier string
+	token            string
+}
+
+// Server A fake Plex, serving the API and the login page
+type Server struct {
+	fixture *Fixture
+
+	mu         sync.Mutex
+	pins       map[int]*pin
+	nextPin    int
+	devices    map[int]*authorizedDevice
+	nextDevice int
+	revoked    map[string]bool
+
+	mux *http.ServeMux
+}
+
+// New creates a fake Plex for the users in the fixture
+func New(fixture *Fixture) *Server {
+	s := &Server{
+		fixture:    fixture,
+		pins:       map[int]*pin{},
+		nextPin:    1,
+		devices:    map[int]*authorizedDevice{},
+		nextDevice: 1,
+		revoked:    map[string]bool{},
+		mux:        http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("POST /api/v2/pins", s.createPin)
+	s.mux.HandleFunc("GET /api/v2/pins/{id}", s.getPin)
+	s.mux.HandleFunc("GET /api/v2/user", s.getUser)
+	s.mux.HandleFunc("GET /api/v2/resources", s.getResources)
+	s.mux.HandleFunc("GET /users/account", s.getLegacyUser)
+	s.mux.HandleFunc("GET /api/resources", s.getLegacyResources)
+	s.mux.HandleFunc("GET /devices.xml", s.getDevices)
+	s.mux.HandleFunc("DELETE /devices/{id}", s.deleteDevice)
+	s.mux.HandleFunc("GET /auth/", s.loginPage)
+	s.mux.HandleFunc("POST /auth/claim", s.claimPin)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Claim logs the user in with a PIN, as the login page does
+func (s *Server) Claim(code, username string) error {
+	user, ok := s.findUser(func(u *User) bool { return u.Username == username })
+	if !ok {
+		return fmt.Errorf("unknown user \"%s\"", username)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pins {
+		if p.code == code {
+			p.token = user.Token
+			s.authorizeDevice(p.clientIdentifier, user.Token)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown pin code \"%s\"", code)
+}
+
+// Add the client to the user's devices, which also reissues their token if it
+// was revoked. Must be called with the lock held
+func (s *Server) authorizeDevice(clientIdentifier, token string) {
+	delete(s.revoked, token)
+	for _, d := range s.devices {
+		if d.clientIdentifier == clientIdentifier && d.token == token {
+			return
+		}
+	}
+
+	s.devices[s.nextDevice] = &authorizedDevice{
+		id:               s.nextDevice,
+		clientIdentifier: clientIdentifier,
+		token:            token,
+	}
+	s.nextDevice++
+}
+
+func (s *Server) findUser(match func(u *User) bool) (*User, bool) {
+	for i := range s.fixture.Users {
+		if match(&s.fixture.Users[i]) {
+			return &s.fixture.Users[i], true
+		}
+	}
+	return nil, false
+}
+
+// Get the user the request's token belongs to
+func (s *Server) tokenUser(r *http.Request) (*User, bool) {
+	token := r.Header.Get("X-Plex-Token")
+	if len(token) == 0 {
+		token = r.URL.Query().Get("X-Plex-Token")
+	}
+	if len(token) == 0 {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	revoked := s.revoked[token]
+	s.mu.Unlock()
+	if revoked {
+		return nil, false
+	}
+
+	return s.findUser(func(u *User) bool { return u.Token == token })
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+type pinResponse struct {
+	XMLName   xml.Name `xml:"pin"`
+	Id        int      `xml:"id,attr"`
+	Code      string   `xml:"code,attr"`
+	AuthToken string   `xml:"authToken,attr,omitempty"`
+}
+
+func (s *Server) createPin(w http.ResponseWriter, r *http.Request) {
+	clientIdentifier := r.Header.Get("X-Plex-Client-Identifier")
+	if len(clientIdentifier) == 0 {
+		http.Error(w, "X-Plex-Client-Identifier header is required", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	p := &pin{
+		id:               s.nextPin,
+		code:             hex.EncodeToString(b),
+		clientIdentifier: clientIdentifier,
+	}
+	s.pins[p.id] = p
+	s.nextPin++
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	writeXML(w, pinResponse{Id: p.id, Code: p.code})
+}
+
+func (s *Server) getPin(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.PathValue("id"))
+
+	s.mu.Lock()
+	p, ok := s.pins[id]
+	var resp pinResponse
+	if ok {
+		resp = pinResponse{Id: p.id, Code: p.code, AuthToken: p.token}
+	}
+	s.mu.Unlock()
+
+	// Pins can only be read by the client that created them
+	if !ok || p.clientIdentifier != r.Header.Get("X-Plex-Client-Identifier") {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeXML(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+type subscription struct {
+	Active bool   `xml:"active,attr" json:"active"`
+	Status string `xml:"status,attr" json:"status"`
+	Plan   string `xml:"plan,attr,omitempty" json:"plan,omitempty"`
+}
+
+type userResponse struct {
+	XMLName      xml.Name     `xml:"user" json:"-"`
+	Id           int64        `xml:"id,attr" json:"id"`
+	UUID         string       `xml:"uuid,attr" json:"uuid"`
+	Username     string       `xml:"username,attr" json:"username"`
+	Title        string       `xml:"title,attr" json:"title"`
+	Email        string       `xml:"email,attr" json:"email"`
+	Thumb        string       `xml:"thumb,attr" json:"thumb"`
+	Home         bool         `xml:"home,attr" json:"home"`
+	Restricted   bool         `xml:"restricted,attr" json:"restricted"`
+	Subscription subscription `xml:"subscription" json:"subscription"`
+}
+
+func newUserResponse(user *User) userResponse {
+	resp := userResponse{
+		Id:           user.Id,
+		UUID:         user.UUID,
+		Username:     user.Username,
+		Title:        user.Title,
+		Email:        user.Email,
+		Thumb:        user.Thumb,
+		Home:         user.Home,
+		Restricted:   user.Restricted,
+		Subscription: subscription{Status: "Inactive"},
+	}
+	if len(resp.Title) == 0 {
+		resp.Title = user.Username
+	}
+	if len(user.Plan) > 0 {
+		resp.Subscription = subscription{Active: true, Status: "Active", Plan: user.Plan}
+	}
+	return resp
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.tokenUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, newUserResponse(user))
+}
+
+func (s *Server) getLegacyUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.tokenUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	writeXML(w, newUserResponse(user))
+}
+
+type resource struct {
+	Name             string `json:"name"`
+	ClientIdentifier string `json:"clientIdentifier"`
+	Provides         string `json:"provides"`
+	Owned            bool   `json:"owned"`
+	Home             bool   `json:"home"`
+}
+
+// The servers the user is a member of, sorted by server identifier
+func userResources(user *User) []resource {
+	servers := make([]string, 0, len(user.Servers))
+	for server := range user.Servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	resources := make([]resource, 0, len(servers))
+	for _, server := range servers {
+		tier := user.Servers[server]
+		resources = append(resources, resource{
+			Name:             server,
+			ClientIdentifier: server,
+			Provides:         "server",
+			Owned:            tier == "owner",
+			Home:             tier == "owner" || tier == "home",
+		})
+	}
+	return resources
+}
+
+func (s *Server) getResources(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.tokenUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, userResources(user))
+}
+
+type device struct {
+	Name             string `xml:"name,attr"`
+	ClientIdentifier string `xml:"clientIdentifier,attr"`
+	Provides         string `xml:"provides,attr"`
+	Owned            string `xml:"owned,attr"`
+	Home             string `xml:"home,attr"`
+}
+
+type resourcesResponse struct {
+	XMLName xml.Name `xml:"MediaContainer"`
+	Size    int      `xml:"size,attr"`
+	Devices []device `xml:"Device"`
+}
+
+func (s *Server) getLegacyResources(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.tokenUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp := resourcesResponse{}
+	for _, resource := range userResources(user) {
+		resp.Devices = append(resp.Devices, device{
+			Name:             resource.Name,
+			ClientIdentifier: resource.ClientIdentifier,
+			Provides:         resource.Provides,
+			Owned:            boolAttr(resource.Owned),
+			Home:             boolAttr(resource.Home),
+		})
+	}
+	resp.Size = len(resp.Devices)
+
+	writeXML(w, resp)
+}
+
+type devicesResponse struct {
+	XMLName xml.Name         `xml:"MediaContainer"`
+	Size    int              `xml:"size,attr"`
+	Devices []deviceResponse `xml:"Device"`
+}
+
+type deviceResponse struct {
+	Id               int    `xml:"id,attr"`
+	ClientIdentifier string `xml:"clientIdentifier,attr"`
+}
+
+// The clients the user has logged in to, sorted by id
+func (s *Server) getDevices(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.tokenUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resp := devicesResponse{}
+	s.mu.Lock()
+	for _, d := range s.devices {
+		if d.token == user.Token {
+			resp.Devices = append(resp.Devices, deviceResponse{Id: d.id, ClientIdentifier: d.clientIdentifier})
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(resp.Devices, func(i, j int) bool { return resp.Devices[i].Id < resp.Devices[j].Id })
+	resp.Size = len(resp.Devices)
+
+	writeXML(w, resp)
+}
+
+// Remove one of the user's devices, which revokes their token
+func (s *Server) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.tokenUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("id"), ".xml"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[id]
+	if err != nil || !ok || d.token != user.Token {
+		http.NotFound(w, r)
+		return
+	}
+
+	delete(s.devices, id)
+	s.revoked[user.Token] = true
+	w.WriteHeader(http.StatusOK)
+}
+
+func boolAttr(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// The login page is sent the pin code and where to return to in the fragment,
+// as app.plex.tv is, so they are read by the page and submitted with the user
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Fake Plex</title>
+</head>
+<body>
+<h1>Fake Plex</h1>
+<form method="post" action="claim">
+<input type="hidden" id="code" name="code">
+<input type="hidden" id="forwardUrl" name="forwardUrl">
+<p>Log in as:</p>
+{{range .}}<p><button type="submit" name="username" value="{{.Username}}">{{.Username}} ({{.Email}})</button></p>
+{{else}}<p>No users in fixture</p>
+{{end}}</form>
+<script>
+var params = new URLSearchParams(window.location.hash.replace(/^#!?\??/, ""));
+document.getElementById("code").value = params.get("code") || "";
+document.getElementById("forwardUrl").value = params.get("forwardUrl") || "";
+</script>
+</body>
+</html>
+`))
+
+func (s *Server) loginPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginTemplate.Execute(w, s.fixture.Users)
+}
+
+func (s *Server) claimPin(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	if len(code) == 0 {
+		http.Error(w, "No pin code, the login page must be opened with a code", http.StatusBadRequest)
+		return
+	}
+
+	err := s.Claim(code, r.FormValue("username"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if forwardURL := r.FormValue("forwardUrl"); len(forwardURL) > 0 {
+		http.Redirect(w, r, forwardURL, http.StatusSeeOther)
+		return
+	}
+	fmt.Fprintln(w, "Logged in, you can close this page")
+}
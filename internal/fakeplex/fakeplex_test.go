@@ -0,0 +1,167 @@
+package fakeplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestFakePlexLoadFixture(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := LoadFixture("../../test/fakeplex.yaml")
+	require.Nil(err)
+	assert.Len(f.Users, 4)
+	assert.Equal("owner", f.Users[0].Username)
+	assert.Equal(map[string]string{"test-server": "owner"}, f.Users[0].Servers)
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	f, err = LoadFixture(write("users.json", `{"users": [{"username": "a", "email": "a@test.com", "token": "a"}]}`))
+	require.Nil(err)
+	assert.Equal("a@test.com", f.Users[0].Email)
+
+	_, err = LoadFixture(write("missing.yaml", "users:\n  - username: a\n"))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "user 1 must have a username, email and token")
+	}
+
+	_, err = LoadFixture(write("tier.yaml", "users:\n  - {username: a, email: a@test.com, token: a, servers: {s: admin}}\n"))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "invalid tier \"admin\"")
+	}
+
+	_, err = LoadFixture(write("dup.yaml", "users:\n  - {username: a, email: a@test.com, token: a}\n  - {username: b, email: b@test.com, token: a}\n"))
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "duplicate token")
+	}
+}
+
+func TestFakePlexLogin(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	f, err := LoadFixture("../../test/fakeplex.yaml")
+	require.Nil(err)
+	s := New(f)
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("X-Plex-Client-Identifier", "client")
+		if len(token) > 0 {
+			r.Header.Set("X-Plex-Token", token)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Should create a pin, without a token until it's claimed
+	w := request("POST", "/api/v2/pins?strong=true", "")
+	require.Equal(201, w.Code)
+	assert.Contains(w.Body.String(), `<pin id="1" code="`)
+	assert.NotContains(w.Body.String(), "authToken")
+	code := strings.Split(strings.Split(w.Body.String(), `code="`)[1], `"`)[0]
+
+	w = request("GET", "/api/v2/pins/1", "")
+	assert.Equal(200, w.Code)
+	assert.NotContains(w.Body.String(), "authToken")
+
+	// Should claim pin from the login page
+	form := url.Values{"code": {code}, "username": {"family"}, "forwardUrl": {"https://auth.example.com/_oauth?state=abc"}}
+	r := httptest.NewRequest("POST", "/auth/claim", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	assert.Equal(http.StatusSeeOther, w.Code)
+	assert.Equal("https://auth.example.com/_oauth?state=abc", w.Header().Get("Location"))
+
+	w = request("GET", "/api/v2/pins/1", "")
+	assert.Contains(w.Body.String(), `authToken="family-token"`)
+
+	// Pins should only be visible to the client that created them
+	r = httptest.NewRequest("GET", "/api/v2/pins/1", nil)
+	r.Header.Set("X-Plex-Client-Identifier", "other")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	assert.Equal(404, w.Code)
+
+	// Should return the user and their servers
+	w = request("GET", "/api/v2/user", "owner-token")
+	assert.Equal(200, w.Code)
+	assert.JSONEq(`{
+		"id": 1, "uuid": "0f1e2d3c4b5a6978", "username": "owner", "title": "The Owner",
+		"email": "owner@example.com", "thumb": "", "home": true, "restricted": false,
+		"subscription": {"active": true, "status": "Active", "plan": "lifetime"}
+	}`, w.Body.String())
+
+	w = request("GET", "/api/v2/resources", "family-token")
+	assert.Equal(200, w.Code)
+	assert.JSONEq(`[{"name": "test-server", "clientIdentifier": "test-server", "provides": "server", "owned": false, "home": true}]`, w.Body.String())
+
+	// Should serve the legacy xml endpoints
+	w = request("GET", "/users/account", "family-token")
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), `username="family" title="family"`)
+	assert.Contains(w.Body.String(), `email="family@example.com"`)
+
+	w = request("GET", "/api/resources", "family-token")
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), `clientIdentifier="test-server" provides="server" owned="0" home="1"`)
+
+	// Should reject unknown tokens
+	w = request("GET", "/api/v2/user", "unknown")
+	assert.Equal(401, w.Code)
+	w = request("GET", "/api/v2/resources", "")
+	assert.Equal(401, w.Code)
+	w = request("GET", "/users/account", "unknown")
+	assert.Equal(401, w.Code)
+
+	// Should reject unknown users and pins
+	assert.NotNil(s.Claim(code, "nobody"))
+	assert.NotNil(s.Claim("nope", "owner"))
+
+	// Login page should list users
+	w = request("GET", "/auth/", "")
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), `value="stranger"`)
+
+	// Should list the client the user logged in to as a device
+	w = request("GET", "/devices.xml", "family-token")
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), `<Device id="1" clientIdentifier="client">`)
+	w = request("GET", "/devices.xml", "owner-token")
+	assert.NotContains(w.Body.String(), "<Device")
+
+	// Should revoke the token when the device is removed
+	w = request("DELETE", "/devices/1.xml", "owner-token")
+	assert.Equal(404, w.Code, "should not remove other users' devices")
+	w = request("DELETE", "/devices/1.xml", "family-token")
+	assert.Equal(200, w.Code)
+	w = request("GET", "/api/v2/user", "family-token")
+	assert.Equal(401, w.Code)
+
+	// Should reissue the token on login
+	w = request("POST", "/api/v2/pins", "")
+	code = strings.Split(strings.Split(w.Body.String(), `code="`)[1], `"`)[0]
+	require.Nil(s.Claim(code, "family"))
+	w = request("GET", "/api/v2/user", "family-token")
+	assert.Equal(200, w.Code)
+}
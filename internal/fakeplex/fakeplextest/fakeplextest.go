@@ -0,0 +1,36 @@
+// Package fakeplextest runs a fake Plex for Go tests. It's kept apart from
+// fakeplex so the fakeplex binary doesn't link the testing package.
+package fakeplextest
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dbendit/traefik-forward-auth-plex-sso/internal/fakeplex"
+)
+
+// Server A fake Plex running for a test
+type Server struct {
+	*fakeplex.Server
+
+	// Base URL of the API, for the "plex-url" option
+	URL string
+	// URL of the login page, for the "plex-login-url" option
+	LoginURL string
+}
+
+// Start runs a fake Plex for the users in the fixture, which is stopped when
+// the test finishes
+func Start(tb testing.TB, fixture *fakeplex.Fixture) *Server {
+	tb.Helper()
+
+	s := fakeplex.New(fixture)
+	hs := httptest.NewServer(s)
+	tb.Cleanup(hs.Close)
+
+	return &Server{
+		Server:   s,
+		URL:      hs.URL,
+		LoginURL: hs.URL + "/auth/#!",
+	}
+}
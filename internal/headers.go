@@ -0,0 +1,129 @@
+package tfaps
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ResponseHeader holds a header to add to authenticated responses, with a
+// value rendered from the identity of the user
+type ResponseHeader struct {
+	Name     string
+	Value    string
+	template *template.Template
+}
+
+// HeaderData holds the identity of an authenticated request, as available to
+// response header templates
+type HeaderData struct {
+	ID         int64
+	UUID       string
+	Username   string
+	Title      string
+	Email      string
+	Thumb      string
+	Tier       string
+	Home       bool
+	Managed    bool
+	Subscribed bool
+	Plan       string
+	Rule       string
+}
+
+// NewHeaderData creates the template data for a request authorized by a rule
+func NewHeaderData(claims Claims, rule string) HeaderData {
+	tier, _ := claims.Tier.MarshalFlag()
+	return HeaderData{
+		ID:         claims.UserID,
+		UUID:       claims.UUID,
+		Username:   claims.Username,
+		Title:      claims.Title,
+		Email:      claims.Email,
+		Thumb:      claims.Thumb,
+		Tier:       tier,
+		Home:       claims.Home,
+		Managed:    claims.Managed,
+		Subscribed: claims.Subscribed,
+		Plan:       claims.Plan,
+		Rule:       rule,
+	}
+}
+
+// UnmarshalFlag converts a header in the format "<name>: <template>" to a
+// ResponseHeader
+func (h *ResponseHeader) UnmarshalFlag(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return fmt.Errorf("invalid response header \"%s\", must be in the format \"<name>: <template>\"", value)
+	}
+
+	name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(parts[0]))
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return fmt.Errorf("invalid response header template for \"%s\": %v", name, err)
+	}
+
+	*h = ResponseHeader{
+		Name:     name,
+		Value:    strings.TrimSpace(parts[1]),
+		template: tmpl,
+	}
+	return nil
+}
+
+// MarshalFlag converts a ResponseHeader back to the "<name>: <template>" format
+func (h ResponseHeader) MarshalFlag() (string, error) {
+	return fmt.Sprintf("%s: %s", h.Name, h.Value), nil
+}
+
+// Render renders the header value for the given identity
+func (h *ResponseHeader) Render(data HeaderData) (string, error) {
+	var b bytes.Buffer
+	err := h.template.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+
+	// Header values can't span lines
+	return strings.NewReplacer("\r", "", "\n", "").Replace(b.String()), nil
+}
+
+// Set the headers identifying an authenticated user on the response, which
+// traefik can pass on to the upstream app via "authResponseHeaders"
+func (s *Server) setIdentityHeaders(cfg *Config, logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string, claims Claims) {
+	w.Header().Set("X-Forwarded-User", claims.Email)
+
+	// Assert the identity with a signed JWT, so upstream apps can verify the
+	// request passed through forward auth
+	if len(cfg.JWTHeader) > 0 && len(cfg.jwtKeys) > 0 {
+		token, err := cfg.jwtKeys[0].Sign(NewJWTClaims(cfg, claims, r.Host, rule))
+		if err != nil {
+			logger.WithField("error", err).Error("Error signing jwt")
+		} else {
+			w.Header().Set(cfg.JWTHeader, token)
+		}
+	}
+
+	data := NewHeaderData(claims, rule)
+	for _, h := range cfg.ResponseHeaders {
+		value, err := h.Render(data)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":  err,
+				"header": h.Name,
+			}).Error("Error rendering response header")
+			continue
+		}
+
+		// Omit headers for details the user doesn't have
+		if len(value) > 0 {
+			w.Header().Set(h.Name, value)
+		}
+	}
+}
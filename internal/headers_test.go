@@ -0,0 +1,90 @@
+package tfaps
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestHeadersDecodeUser(t *testing.T) {
+	assert := assert.New(t)
+
+	var user User
+	err := xml.Unmarshal([]byte(`<user id="123" uuid="abc" username="jane" email="jane@example.com" thumb="https://plex.tv/users/abc/avatar" home="1" restricted="1"></user>`), &user)
+	require.Nil(t, err)
+
+	claims := NewClaims(config, user, HomeUser)
+	assert.Equal(int64(123), claims.UserID)
+	assert.Equal("jane", claims.Username)
+	assert.Equal("https://plex.tv/users/abc/avatar", claims.Thumb)
+	assert.True(claims.Home)
+	assert.True(claims.Managed)
+}
+
+func TestHeadersResponseHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	var h ResponseHeader
+	assert.Nil(h.UnmarshalFlag("x-webauth-user: {{.Username}}"))
+	assert.Equal("X-Webauth-User", h.Name)
+	flag, _ := h.MarshalFlag()
+	assert.Equal("X-Webauth-User: {{.Username}}", flag)
+
+	value, err := h.Render(HeaderData{Username: "jane"})
+	assert.Nil(err)
+	assert.Equal("jane", value)
+
+	// Should remove line breaks
+	value, err = h.Render(HeaderData{Username: "jane\r\nX-Injected: 1"})
+	assert.Nil(err)
+	assert.Equal("janeX-Injected: 1", value)
+
+	// Should require name and valid template
+	assert.Error(h.UnmarshalFlag("{{.Username}}"))
+	assert.Error(h.UnmarshalFlag(": {{.Username}}"))
+	assert.Error(h.UnmarshalFlag("X-User: {{.Username"))
+
+	// Should fail on unknown fields
+	assert.Nil(h.UnmarshalFlag("X-User: {{.Missing}}"))
+	_, err = h.Render(HeaderData{})
+	assert.Error(err)
+}
+
+func TestHeadersAuthHandler(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{
+		"--response-header=X-WEBAUTH-USER: {{.Username}}",
+		"--response-header=X-Plex-User-Id: {{.ID}}",
+		"--response-header=X-Plex-Tier: {{.Tier}}",
+		"--response-header=X-Plex-Managed: {{if .Managed}}true{{end}}",
+		"--response-header=X-Rule: {{.Rule}}",
+	})
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	c := mustMakeCookie(t, r, NewClaims(config, User{Id: 42, Username: "jane", Email: "jane@example.com"}, HomeUser))
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/")
+	r.AddCookie(c)
+	w := httptest.NewRecorder()
+	s.RootHandler(w, r)
+
+	assert.Equal(200, w.Code)
+	assert.Equal("jane@example.com", w.Header().Get("X-Forwarded-User"))
+	assert.Equal("jane", w.Header().Get("X-Webauth-User"))
+	assert.Equal("42", w.Header().Get("X-Plex-User-Id"))
+	assert.Equal("home", w.Header().Get("X-Plex-Tier"))
+	assert.Equal("default", w.Header().Get("X-Rule"))
+	_, ok := w.Header()["X-Plex-Managed"]
+	assert.False(ok, "empty headers should be omitted")
+}
@@ -0,0 +1,244 @@
+package tfaps
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// JWTKey holds a private key used to sign identity assertions
+type JWTKey struct {
+	ID  string
+	Alg string
+	key crypto.Signer
+}
+
+// JWK is the public part of a JWTKey, as published in the JWKS
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWTClaims holds the claims of an identity assertion
+type JWTClaims struct {
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	UserID   int64  `json:"uid,omitempty"`
+	UUID     string `json:"uuid,omitempty"`
+	Username string `json:"preferred_username,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email"`
+	Tier     string `json:"tier,omitempty"`
+	Rule     string `json:"rule"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// LoadJWTKeys reads the PEM encoded private keys configured by "jwt-key"
+func LoadJWTKeys(paths []string) ([]*JWTKey, error) {
+	keys := make([]*JWTKey, 0, len(paths))
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read jwt key: %v", err)
+		}
+
+		key, err := ParseJWTKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt key %s: %v", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// ParseJWTKey parses a PEM encoded RSA, ECDSA or Ed25519 private key
+func ParseJWTKey(b []byte) (*JWTKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type \"%s\"", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := &JWTKey{}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.Alg, k.key = "RS256", key
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("ECDSA keys must use the P-256 curve")
+		}
+		k.Alg, k.key = "ES256", key
+	case ed25519.PrivateKey:
+		k.Alg, k.key = "EdDSA", key
+	default:
+		return nil, errors.New("unsupported key type, must be RSA, ECDSA or Ed25519")
+	}
+
+	k.ID = k.thumbprint()
+	return k, nil
+}
+
+// JWK returns the public key in JWK format
+func (k *JWTKey) JWK() JWK {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Alg}
+	switch pub := k.key.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = "P-256"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return jwk
+}
+
+// Key id as defined by RFC 7638, so it's stable for the same key
+func (k *JWTKey) thumbprint() string {
+	jwk := k.JWK()
+
+	// Members must be in lexicographic order
+	var members string
+	switch jwk.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Crv, jwk.Kty, jwk.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Sign creates a compact JWS of the given claims
+func (k *JWTKey) Sign(claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": k.Alg,
+		"kid": k.ID,
+		"typ": "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch key := k.key.(type) {
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		// JWS uses the fixed size r || s encoding rather than ASN.1
+		sum := sha256.Sum256([]byte(input))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, sum[:])
+		if err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(input))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// NewJWTClaims creates the claims asserting a request to the given host was
+// authorized by a rule
+func NewJWTClaims(cfg *Config, claims Claims, host, rule string) JWTClaims {
+	tier, _ := claims.Tier.MarshalFlag()
+	now := time.Now()
+	subject := claims.Email
+	if claims.UserID != 0 {
+		subject = strconv.FormatInt(claims.UserID, 10)
+	}
+
+	return JWTClaims{
+		Subject:  subject,
+		Audience: host,
+		UserID:   claims.UserID,
+		UUID:     claims.UUID,
+		Username: claims.Username,
+		Name:     claims.Title,
+		Email:    claims.Email,
+		Tier:     tier,
+		Rule:     rule,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(cfg.JWTLifetime).Unix(),
+	}
+}
+
+// JWKSHandler publishes the public keys JWTs can be verified with
+func (s *Server) JWKSHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := make([]JWK, 0, len(cfg.jwtKeys))
+		for _, key := range cfg.jwtKeys {
+			keys = append(keys, key.JWK())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(map[string][]JWK{"keys": keys})
+	}
+}
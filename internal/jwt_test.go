@@ -0,0 +1,185 @@
+package tfaps
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestJWTParseJWTKey(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	key, err := ParseJWTKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	require.Nil(t, err)
+	assert.Equal("RS256", key.Alg)
+	assert.Equal("RSA", key.JWK().Kty)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	b, _ := x509.MarshalECPrivateKey(ecKey)
+	key, err = ParseJWTKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	require.Nil(t, err)
+	assert.Equal("ES256", key.Alg)
+	assert.Equal("P-256", key.JWK().Crv)
+
+	key, err = ParseJWTKey(testJWTKeyPEM(t))
+	require.Nil(t, err)
+	assert.Equal("EdDSA", key.Alg)
+	assert.Equal("OKP", key.JWK().Kty)
+	assert.Len(key.ID, 43, "key id should be a sha256 thumbprint")
+
+	// Should reject unsupported keys
+	ecKey, _ = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	b, _ = x509.MarshalECPrivateKey(ecKey)
+	_, err = ParseJWTKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	assert.Error(err)
+	_, err = ParseJWTKey([]byte("not a key"))
+	assert.Error(err)
+}
+
+func TestJWTSign(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{})
+	claims := NewJWTClaims(config, NewClaims(config, User{Id: 42, Email: "test@test.com"}, Owner), "app.example.com", "admin")
+
+	// RS256
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key, err := ParseJWTKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	require.Nil(t, err)
+	token, err := key.Sign(claims)
+	require.Nil(t, err)
+	input, sig := testSplitJWT(t, token)
+	sum := sha256.Sum256([]byte(input))
+	assert.Nil(rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, sum[:], sig))
+
+	// ES256
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b, _ := x509.MarshalECPrivateKey(ecKey)
+	key, err = ParseJWTKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	require.Nil(t, err)
+	token, err = key.Sign(claims)
+	require.Nil(t, err)
+	input, sig = testSplitJWT(t, token)
+	sum = sha256.Sum256([]byte(input))
+	if assert.Len(sig, 64) {
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		assert.True(ecdsa.Verify(&ecKey.PublicKey, sum[:], r, s))
+	}
+
+	// EdDSA
+	key, err = ParseJWTKey(testJWTKeyPEM(t))
+	require.Nil(t, err)
+	token, err = key.Sign(claims)
+	require.Nil(t, err)
+	input, sig = testSplitJWT(t, token)
+	assert.True(ed25519.Verify(key.key.Public().(ed25519.PublicKey), []byte(input), sig))
+
+	// Should include header and claims
+	parts := strings.Split(token, ".")
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	assert.JSONEq(`{"alg":"EdDSA","kid":"`+key.ID+`","typ":"JWT"}`, string(header))
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var decoded map[string]interface{}
+	require.Nil(t, json.Unmarshal(payload, &decoded))
+	assert.Equal("42", decoded["sub"])
+	assert.Equal("app.example.com", decoded["aud"])
+	assert.Equal("owner", decoded["tier"])
+	assert.Equal("admin", decoded["rule"])
+	assert.Equal("test@test.com", decoded["email"])
+}
+
+func TestJWTAuthHandler(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+
+	// Write two keys, so the second is published for rotation
+	dir := t.TempDir()
+	current := filepath.Join(dir, "current.pem")
+	next := filepath.Join(dir, "next.pem")
+	require.Nil(t, os.WriteFile(current, testJWTKeyPEM(t), 0600))
+	require.Nil(t, os.WriteFile(next, testJWTKeyPEM(t), 0600))
+
+	setTestConfig([]string{
+		"--jwt-header=X-Forwarded-Jwt",
+		"--jwt-key=" + current,
+		"--jwt-key=" + next,
+		"--jwt-lifetime=30",
+	})
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	// Should set signed header
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/")
+	r.AddCookie(mustMakeCookie(t, r, NewClaims(config, User{Email: "test@test.com"}, NoAccess)))
+	w := httptest.NewRecorder()
+	s.RootHandler(w, r)
+	assert.Equal(200, w.Code)
+	token := w.Header().Get("X-Forwarded-Jwt")
+	input, sig := testSplitJWT(t, token)
+	assert.True(ed25519.Verify(config.jwtKeys[0].key.Public().(ed25519.PublicKey), []byte(input), sig), "should be signed with first key")
+
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	var claims JWTClaims
+	require.Nil(t, json.Unmarshal(payload, &claims))
+	assert.Equal("test@test.com", claims.Subject)
+	assert.Equal("default", claims.Rule)
+	assert.InDelta(time.Now().Add(30*time.Second).Unix(), claims.Expires, 2)
+
+	// Should publish both keys
+	r = httptest.NewRequest("GET", "http://app.example.com/_oauth/.well-known/jwks.json", nil)
+	w = httptest.NewRecorder()
+	s.RootHandler(w, r)
+	assert.Equal(200, w.Code)
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&jwks))
+	if assert.Len(jwks.Keys, 2) {
+		assert.Equal(config.jwtKeys[0].ID, jwks.Keys[0].Kid)
+		assert.Equal(config.jwtKeys[1].ID, jwks.Keys[1].Kid)
+		assert.Equal("sig", jwks.Keys[0].Use)
+	}
+}
+
+func testJWTKeyPEM(t *testing.T) []byte {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+}
+
+func testSplitJWT(t *testing.T, token string) (string, []byte) {
+	i := strings.LastIndex(token, ".")
+	require.True(t, i > 0, "token should have a signature")
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	require.Nil(t, err)
+	return token[:i], sig
+}
@@ -15,7 +15,7 @@ func NewDefaultLogger() *logrus.Logger {
 	logrus.SetOutput(os.Stdout)
 
 	// Set logger format
-	switch config.LogFormat {
+	switch currentConfig().LogFormat {
 	case "pretty":
 		break
 	case "json":
@@ -29,7 +29,7 @@ func NewDefaultLogger() *logrus.Logger {
 	}
 
 	// Set logger level
-	switch config.LogLevel {
+	switch currentConfig().LogLevel {
 	case "trace":
 		logrus.SetLevel(logrus.TraceLevel)
 	case "debug":
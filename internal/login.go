@@ -0,0 +1,242 @@
+package tfaps
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Page shown to users that need to log in, so a PIN is only created with
+// Plex when they choose to
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body { margin: 0; min-height: 100vh; display: flex; align-items: center; justify-content: center; background: #1f1f1f; color: #eee; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; }
+main { text-align: center; padding: 2em; }
+a.button { display: inline-block; margin-top: 1em; padding: 0.75em 1.5em; border-radius: 4px; background: #e5a00d; color: #1f1f1f; font-weight: bold; text-decoration: none; }
+</style>
+</head>
+<body>
+<main>
+<h1>Sign in required</h1>
+<p>{{.Host}} requires you to sign in with your Plex account.</p>
+<a class="button" href="{{.LoginURL}}">Sign in with Plex</a>
+</main>
+</body>
+</html>
+`))
+
+// Whether a request is a browser navigating to a page, rather than loading a
+// resource on a page or making an API request
+func isNavigation(r *http.Request) bool {
+	// Sent by modern browsers
+	if mode := r.Header.Get("Sec-Fetch-Mode"); len(mode) > 0 {
+		return mode == "navigate"
+	}
+
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return false
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// Get the IP address of the client making a request. Clients can send their
+// own X-Forwarded-For, so the last entry, appended by traefik, is used
+func clientIP(r *http.Request) string {
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) > 0 {
+		entries := strings.Split(forwarded[len(forwarded)-1], ",")
+		if ip := strings.TrimSpace(entries[len(entries)-1]); len(ip) > 0 {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Get the url of the login endpoint, which returns the user to the original
+// url following login
+func loginUri(cfg *Config, r *http.Request) string {
+	q := url.Values{}
+	q.Set("rd", loginReturnUrl(r))
+	return fmt.Sprintf("%s/login?%s", redirectUri(cfg, r), q.Encode())
+}
+
+// Respond to a request that needs the user to log in. Browsers are shown a
+// page to start logging in from, anything else is just refused
+func (s *Server) authRequired(cfg *Config, logger *logrus.Entry, w http.ResponseWriter, r *http.Request) {
+	if !isNavigation(r) {
+		logger.Debug("Refusing unauthenticated request that isn't a page navigation")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(401)
+	err := loginTemplate.Execute(w, struct {
+		Host     string
+		LoginURL string
+	}{
+		Host:     r.Host,
+		LoginURL: loginUri(cfg, r),
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("Error rendering login page")
+	}
+}
+
+// LoginHandler starts a login, creating a PIN with Plex and redirecting the
+// user to log in with it
+func (s *Server) LoginHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Login", "default", "Starting login")
+
+		// Validate redirect
+		redirect := r.URL.Query().Get("rd")
+		redirectURL, err := ValidateRedirect(cfg, r, redirect)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":    err,
+				"redirect": Sanitize(redirect),
+			}).Warn("Invalid redirect")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
+		if len(redirect) > maxReturnUrlLength {
+			logger.WithField("redirect", Sanitize(redirect)).Warn("Original url is too long to store, user will be returned to a shortened url")
+			redirect = fmt.Sprintf("%s://%s/", redirectURL.Scheme, redirectURL.Host)
+		}
+
+		// Each login creates a PIN with Plex, which rate limits us
+		if ok, wait := s.logins.allow(clientIP(r), cfg.LoginRateLimit, time.Now()); !ok {
+			logger.WithField("client_ip", Sanitize(clientIP(r))).Warn("Client has started too many logins")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many login attempts, please try again shortly", http.StatusTooManyRequests)
+			return
+		}
+
+		s.loginRedirect(cfg, logger, w, r, redirect)
+	}
+}
+
+// Create a PIN and redirect the user to log in with Plex, returning to the
+// redirect url following login
+func (s *Server) loginRedirect(cfg *Config, logger *logrus.Entry, w http.ResponseWriter, r *http.Request, redirect string) {
+	pin, err := s.plex.GetPin(r.Context(), logger)
+	if err != nil {
+		logger.WithField("error", err).Error("Error retrieving pin")
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	// Generate nonce to bind the CSRF cookie to this login
+	nonce, err := Nonce()
+	if err != nil {
+		logger.WithField("error", err).Error("Error generating nonce")
+		http.Error(w, "Service unavailable", 503)
+		return
+	}
+
+	// Set the CSRF cookie
+	csrf := MakeCSRFCookie(cfg, r, nonce, pin.Id, redirect)
+	http.SetCookie(w, csrf)
+
+	if !cfg.InsecureCookie && r.Header.Get("X-Forwarded-Proto") != "https" {
+		logger.Warn("You are using \"secure\" cookies for a request that was not " +
+			"received via https. You should either redirect to https or pass the " +
+			"\"insecure-cookie\" config option to permit cookies via http.")
+	}
+
+	// Forward them on
+	q := url.Values{}
+	q.Set("state", nonce)
+	loginURL := s.plex.GetLoginURL(fmt.Sprintf("%s?%s", redirectUri(cfg, r), q.Encode()), pin.Code)
+	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+
+	logger.WithFields(logrus.Fields{
+		"csrf_cookie": csrf,
+		"login_url":   loginURL,
+	}).Debug("Set CSRF cookie and redirected to provider login url")
+}
+
+type loginBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// loginLimiter limits how often each client IP can start a login. Each client
+// can start up to the limit at once, after which it can start one each
+// minute/limit
+type loginLimiter struct {
+	mu      sync.Mutex
+	clients map[string]loginBucket
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		clients: map[string]loginBucket{},
+	}
+}
+
+// Record a login by the client if it's within the limit per minute, or return
+// how long until it will be. A limit of 0 allows all logins
+func (l *loginLimiter) allow(ip string, limit int, now time.Time) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.clients[ip]
+	if !ok {
+		b = loginBucket{tokens: float64(limit), updated: now}
+	}
+	b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.updated).Minutes()*float64(limit))
+	b.updated = now
+
+	if b.tokens < 1 {
+		l.clients[ip] = b
+		return false, time.Duration((1 - b.tokens) / float64(limit) * float64(time.Minute))
+	}
+
+	b.tokens--
+	l.clients[ip] = b
+	return true, 0
+}
+
+// Remove clients that haven't started a login since the given time, which
+// have their full limit again
+func (l *loginLimiter) prune(before time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, b := range l.clients {
+		if b.updated.Before(before) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// Remove clients from the login limiter that have their full limit again
+func (s *Server) pruneLogins() {
+	s.logins.prune(time.Now().Add(-time.Minute))
+}
@@ -0,0 +1,196 @@
+package tfaps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Plex client counting the pins created
+type pinPlexClient struct {
+	PlexClient
+	pins int
+}
+
+func (p *pinPlexClient) GetPin(ctx context.Context, logger *logrus.Entry) (Pin, error) {
+	p.pins++
+	return Pin{Id: "1", Code: "abcd"}, nil
+}
+
+func (p *pinPlexClient) GetLoginURL(redirectURI, code string) string {
+	return "https://plex.example.com/auth#?code=" + code
+}
+
+/**
+ * Tests
+ */
+
+func TestLoginIsNavigation(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	assert.False(isNavigation(r), "request without headers should not be a navigation")
+
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	assert.True(isNavigation(r))
+
+	r.Header.Set("X-Requested-With", "XMLHttpRequest")
+	assert.False(isNavigation(r), "xhr should not be a navigation")
+
+	r.Header.Set("Sec-Fetch-Mode", "navigate")
+	assert.True(isNavigation(r), "fetch metadata should take precedence")
+
+	r = httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.Header.Set("Accept", "image/avif,image/webp,*/*")
+	assert.False(isNavigation(r), "image should not be a navigation")
+
+	r.Header.Set("Accept", "application/json")
+	assert.False(isNavigation(r), "api request should not be a navigation")
+
+	r.Header.Set("Accept", "text/html")
+	r.Header.Set("Sec-Fetch-Mode", "no-cors")
+	assert.False(isNavigation(r))
+}
+
+func TestLoginClientIP(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal("10.0.0.1", clientIP(r))
+
+	r.Header.Set("X-Forwarded-For", "192.168.1.1")
+	assert.Equal("192.168.1.1", clientIP(r))
+
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 192.168.1.1")
+	assert.Equal("192.168.1.1", clientIP(r), "should ignore entries sent by the client")
+
+	r.Header.Add("X-Forwarded-For", "192.168.1.2")
+	assert.Equal("192.168.1.2", clientIP(r))
+
+	r.Header.Set("X-Forwarded-For", "192.168.1.1,")
+	assert.Equal("10.0.0.1", clientIP(r), "should fall back to remote address")
+}
+
+func TestLoginAuthRequired(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{"--secret=verysecret"})
+	plex := &pinPlexClient{}
+	s := NewServerWithPlexClient(plex)
+	t.Cleanup(s.Close)
+
+	request := func(uri string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		r.Header.Set("X-Forwarded-For", "192.168.1.1")
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w
+	}
+
+	// Should refuse resources and api requests
+	for _, accept := range []string{"", "application/json", "image/png", "*/*"} {
+		w := request("/page", map[string]string{"Accept": accept})
+		assert.Equal(401, w.Code)
+		assert.Equal("Not authorized\n", w.Body.String())
+	}
+	w := request("/api", map[string]string{"Accept": "text/html", "X-Requested-With": "XMLHttpRequest"})
+	assert.Equal(401, w.Code)
+	assert.Equal("Not authorized\n", w.Body.String())
+
+	// Should show sign in page to browsers
+	w = request("/page?a=b", map[string]string{"Accept": "text/html"})
+	assert.Equal(401, w.Code)
+	assert.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(w.Body.String(), "Sign in with Plex")
+	assert.Contains(w.Body.String(), `href="https://app.example.com/_oauth/login?rd=https%3A%2F%2Fapp.example.com%2Fpage%3Fa%3Db"`)
+	assert.Equal(0, plex.pins, "pin should not be created until user clicks")
+
+	// Should create pin on click
+	w = request("/_oauth/login?rd="+url.QueryEscape("https://app.example.com/page?a=b"), nil)
+	assert.Equal(307, w.Code)
+	assert.Equal("https://plex.example.com/auth#?code=abcd", w.Header().Get("Location"))
+	assert.Equal(1, plex.pins)
+	if cookies := w.Result().Cookies(); assert.Len(cookies, 1) {
+		assert.True(strings.HasPrefix(cookies[0].Name, config.CSRFCookieName))
+	}
+
+	// Should not redirect elsewhere
+	w = request("/_oauth/login?rd="+url.QueryEscape("https://evil.com/"), nil)
+	assert.Equal(401, w.Code)
+	assert.Equal(1, plex.pins)
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{"--secret=verysecret", "--login-rate-limit=2"})
+	plex := &pinPlexClient{}
+	s := NewServerWithPlexClient(plex)
+	t.Cleanup(s.Close)
+
+	login := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", "/_oauth/login?rd="+url.QueryEscape("https://app.example.com/"))
+		r.Header.Set("X-Forwarded-For", ip)
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w
+	}
+
+	// Should limit each client
+	assert.Equal(307, login("192.168.1.1").Code)
+	assert.Equal(307, login("192.168.1.1").Code)
+	w := login("192.168.1.1")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("30", w.Header().Get("Retry-After"))
+	assert.Equal(307, login("192.168.1.2").Code, "other clients should not be limited")
+	assert.Equal(http.StatusTooManyRequests, login("1.2.3.4, 192.168.1.1").Code, "client should not be able to set its ip")
+	assert.Equal(3, plex.pins)
+}
+
+func TestLoginLimiter(t *testing.T) {
+	assert := assert.New(t)
+	l := newLoginLimiter()
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a", 3, now)
+		assert.True(ok)
+	}
+	ok, wait := l.allow("a", 3, now)
+	assert.False(ok)
+	assert.Equal(20*time.Second, wait)
+
+	// Should allow again once a login is available
+	ok, _ = l.allow("a", 3, now.Add(20*time.Second))
+	assert.True(ok)
+	ok, _ = l.allow("a", 3, now.Add(20*time.Second))
+	assert.False(ok)
+
+	// Should not limit when disabled
+	ok, _ = l.allow("a", 0, now)
+	assert.True(ok)
+
+	// Should prune clients that have their full limit again
+	l.allow("b", 3, now.Add(2*time.Minute))
+	l.prune(now.Add(time.Minute))
+	assert.NotContains(l.clients, "a")
+	assert.Contains(l.clients, "b")
+}
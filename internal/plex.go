@@ -1,18 +1,123 @@
 package tfaps
 
 import (
+	"context"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const pinURL = "https://plex.tv/api/v2/pins"
-const loginURL = "https://app.plex.tv/auth/#!"
-const userURL = "https://plex.tv/users/account"
-const resourcesURL = "https://plex.tv/api/resources"
+// Paths of the Plex API, relative to the base URL
+const pinPath = "/api/v2/pins"
+const userPath = "/api/v2/user"
+const resourcesPath = "/api/v2/resources"
+const legacyUserPath = "/users/account"
+const legacyResourcesPath = "/api/resources"
+const devicesPath = "/devices.xml"
+const devicePath = "/devices/%s.xml"
+
+// Formats of Plex API responses, sent in the Accept header
+const (
+	plexXML  = "application/xml"
+	plexJSON = "application/json"
+)
+
+// Longest time to wait before retrying a request, whatever Plex asks for
+const maxPlexBackoff = 30 * time.Second
+
+// Errors returned for Plex error responses, which can be checked with errors.Is
+var (
+	ErrPlexUnauthorized = errors.New("plex rejected the token")
+	ErrPlexNotFound     = errors.New("plex resource not found")
+	ErrPlexRateLimited  = errors.New("plex rate limit exceeded")
+)
+
+// PlexStatusError An error response from Plex
+type PlexStatusError struct {
+	StatusCode int
+	retryAfter time.Duration
+}
+
+func (e *PlexStatusError) Error() string {
+	return fmt.Sprintf("failure response from request: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Is allows the status to be matched against ErrPlexUnauthorized,
+// ErrPlexNotFound and ErrPlexRateLimited
+func (e *PlexStatusError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return target == ErrPlexUnauthorized
+	case http.StatusNotFound:
+		return target == ErrPlexNotFound
+	case http.StatusTooManyRequests:
+		return target == ErrPlexRateLimited
+	}
+	return false
+}
+
+// Whether a request with this error might succeed if retried
+func (e *PlexStatusError) temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// PlexClient The calls made to Plex to authenticate users
+type PlexClient interface {
+	// GetPin Retrieve a Pin (with Id and Code) from Plex
+	GetPin(ctx context.Context, logger *logrus.Entry) (Pin, error)
+	// GetLoginURL Construct a login URL for authenticating with Plex
+	GetLoginURL(redirectURI, code string) string
+	// GetToken Retrieve an authentication Token using a Pin
+	GetToken(ctx context.Context, logger *logrus.Entry, pinId string) (string, error)
+	// GetUser Retrieve an authenticated User
+	GetUser(ctx context.Context, logger *logrus.Entry, token string) (User, error)
+	// GetAccessTier Retrieve the access tier of this user on the given server
+	GetAccessTier(ctx context.Context, logger *logrus.Entry, token, serverIdentifier string) (AccessTier, error)
+	// RevokeToken Remove this service from the User's authorized devices
+	RevokeToken(ctx context.Context, logger *logrus.Entry, token string) error
+}
+
+// HTTPPlexClient The default PlexClient, which calls the Plex API
+type HTTPPlexClient struct {
+	// Base URL of the Plex API
+	URL string
+	// URL of the Plex login page
+	LoginURL string
+	// Time allowed for each attempt at a request
+	Timeout time.Duration
+	// Number of times to retry requests that fail with a 5xx or 429 response
+	// or a network error
+	Retries int
+	// Delay before the first retry, doubled for each following retry
+	Backoff time.Duration
+
+	Client *http.Client
+
+	// Config the client was created from, which identifies this service to
+	// Plex. Kept for the life of the client, so a reload can't change the
+	// identity partway through a login
+	config *Config
+}
+
+// NewPlexClient creates a PlexClient from the config
+func NewPlexClient(c *Config) *HTTPPlexClient {
+	return &HTTPPlexClient{
+		URL:      strings.TrimSuffix(c.PlexURL, "/"),
+		LoginURL: c.PlexLoginURL,
+		Timeout:  c.PlexTimeout,
+		Retries:  c.PlexRetries,
+		Backoff:  500 * time.Millisecond,
+		Client:   &http.Client{},
+		config:   c,
+	}
+}
 
 type AccessTier int64
 
@@ -37,6 +142,36 @@ func (a AccessTier) String() string {
 	return "Unknown"
 }
 
+// UnmarshalFlag converts a tier name ("owner", "home" or "friend") to an AccessTier
+func (a *AccessTier) UnmarshalFlag(value string) error {
+	switch strings.ToLower(value) {
+	case "owner":
+		*a = Owner
+	case "home":
+		*a = HomeUser
+	case "friend":
+		*a = NormalUser
+	case "", "none":
+		*a = NoAccess
+	default:
+		return fmt.Errorf("invalid access tier \"%s\", must be \"owner\", \"home\" or \"friend\"", value)
+	}
+	return nil
+}
+
+// MarshalFlag converts an AccessTier back to a tier name
+func (a AccessTier) MarshalFlag() (string, error) {
+	switch a {
+	case Owner:
+		return "owner", nil
+	case HomeUser:
+		return "home", nil
+	case NormalUser:
+		return "friend", nil
+	}
+	return "", nil
+}
+
 // Pin A pin response from Plex's auth system
 type Pin struct {
 	XMLName xml.Name `xml:"pin"`
@@ -45,13 +180,39 @@ type Pin struct {
 	Token   string   `xml:"authToken,attr"`
 }
 
-// User A user record from Plex, deserialized from XML
+// User A user record from Plex, deserialized from JSON, or XML from the
+// legacy endpoint
 type User struct {
-	XMLName xml.Name `xml:"user"`
-	Email   string   `xml:"email,attr"`
+	XMLName      xml.Name     `xml:"user" json:"-"`
+	Id           int64        `xml:"id,attr" json:"id"`
+	UUID         string       `xml:"uuid,attr" json:"uuid"`
+	Username     string       `xml:"username,attr" json:"username"`
+	Title        string       `xml:"title,attr" json:"title"`
+	Email        string       `xml:"email,attr" json:"email"`
+	Thumb        string       `xml:"thumb,attr" json:"thumb"`
+	Home         bool         `xml:"home,attr" json:"home"`
+	Restricted   bool         `xml:"restricted,attr" json:"restricted"`
+	Subscription Subscription `xml:"subscription" json:"subscription"`
 }
 
-// Resources A collection of device resources associated with a User
+// Subscription A user's Plex Pass subscription
+type Subscription struct {
+	Active bool   `xml:"active,attr" json:"active"`
+	Status string `xml:"status,attr" json:"status"`
+	Plan   string `xml:"plan,attr" json:"plan"`
+}
+
+// Resource A device resource associated with a User, deserialized from JSON
+type Resource struct {
+	Name             string `json:"name"`
+	ClientIdentifier string `json:"clientIdentifier"`
+	Provides         string `json:"provides"`
+	Owned            bool   `json:"owned"`
+	Home             bool   `json:"home"`
+}
+
+// Resources A collection of device resources associated with a User, from the
+// legacy endpoint
 type Resources struct {
 	XMLName xml.Name `xml:"MediaContainer"`
 	Devices []struct {
@@ -61,47 +222,144 @@ type Resources struct {
 	} `xml:"Device"`
 }
 
-func addHeaders(req *http.Request) {
-	req.Header.Add("X-Plex-Product", config.Product)
-	req.Header.Add("X-Plex-Client-Identifier", config.ClientIdentifier)
+// Devices A collection of devices authorized to access a User's account
+type Devices struct {
+	XMLName xml.Name `xml:"MediaContainer"`
+	Devices []struct {
+		Id               string `xml:"id,attr"`
+		ClientIdentifier string `xml:"clientIdentifier,attr"`
+	} `xml:"Device"`
 }
 
-func addTokenHeader(req *http.Request, token string) {
-	req.Header.Add("X-Plex-Token", token)
+func addHeaders(c *Config, req *http.Request) {
+	req.Header.Add("X-Plex-Product", c.Product)
+	req.Header.Add("X-Plex-Client-Identifier", c.ClientIdentifier)
+
+	// Describe this service in the user's list of authorized devices
+	for header, value := range map[string]string{
+		"X-Plex-Device":           c.PlexDevice,
+		"X-Plex-Device-Name":      c.PlexDeviceName,
+		"X-Plex-Model":            c.PlexModel,
+		"X-Plex-Platform":         c.PlexPlatform,
+		"X-Plex-Platform-Version": c.PlexPlatformVersion,
+		"X-Plex-Version":          c.PlexVersion,
+	} {
+		if len(value) > 0 {
+			req.Header.Add(header, value)
+		}
+	}
+}
+
+// Make a request to the Plex API, decoding the response into output unless
+// it's nil. Each attempt is limited by the timeout, and temporary failures are
+// retried with backoff until the retries run out or ctx is done
+func (p *HTTPPlexClient) doReq(ctx context.Context, logger *logrus.Entry, method, path, token, format string, output interface{}) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var wait time.Duration
+		wait, err = p.attempt(ctx, logger, method, path, token, format, output)
+		if err == nil || wait < 0 || attempt >= p.Retries {
+			return err
+		}
+
+		// Exponential backoff, unless Plex says how long to wait
+		if wait == 0 {
+			wait = p.Backoff << attempt
+		}
+		if wait > maxPlexBackoff {
+			wait = maxPlexBackoff
+		}
+		logger.WithFields(logrus.Fields{
+			"error":   err,
+			"attempt": attempt + 1,
+			"wait":    wait,
+		}).Warn("Retrying failed request")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
 }
 
-func doReq(logger *logrus.Entry, req *http.Request, output interface{}) error {
-	client := http.Client{}
+// Make a single attempt at a request. The duration is how long to wait before
+// retrying, 0 to use the backoff or negative if it shouldn't be retried
+func (p *HTTPPlexClient) attempt(ctx context.Context, logger *logrus.Entry, method, path, token, format string, output interface{}) (time.Duration, error) {
+	parent := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.URL+path, nil)
+	if err != nil {
+		return -1, errors.New("unable to construct request")
+	}
+	addHeaders(p.config, req)
+	req.Header.Add("Accept", format)
+	if len(token) > 0 {
+		req.Header.Add("X-Plex-Token", token)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		logger.WithField("error", err).Error("Error sending request")
-		return errors.New("failure while sending request")
+
+		// Don't retry once the caller has given up
+		if parent.Err() != nil {
+			return -1, parent.Err()
+		}
+		return 0, errors.New("failure while sending request")
 	}
 	defer resp.Body.Close()
-	err = xml.NewDecoder(resp.Body).Decode(output)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.WithField("status", resp.StatusCode).Error("Error response from request")
+		statusErr := &PlexStatusError{StatusCode: resp.StatusCode}
+		if !statusErr.temporary() {
+			return -1, statusErr
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, statusErr
+		}
+		return 0, statusErr
+	}
+
+	// Some requests have no response to decode
+	if output == nil {
+		return -1, nil
+	}
+
+	if format == plexJSON {
+		err = json.NewDecoder(resp.Body).Decode(output)
+	} else {
+		err = xml.NewDecoder(resp.Body).Decode(output)
+	}
 	if err != nil {
 		logger.WithField("error", err).Error("Error unmarshalling response")
-		return errors.New("failure unmarshalling response")
+		return -1, errors.New("failure unmarshalling response")
 	}
 
-	return nil
+	return -1, nil
 }
 
 // GetPin Retrieve a Pin (with Id and Code) from Plex
-func GetPin(logger *logrus.Entry) (Pin, error) {
-	pinUrl, _ := url.Parse(pinURL)
-
+func (p *HTTPPlexClient) GetPin(ctx context.Context, logger *logrus.Entry) (Pin, error) {
 	q := url.Values{}
 	q.Set("strong", "true")
-	pinUrl.RawQuery = q.Encode()
 
-	req, err := http.NewRequest("POST", pinUrl.String(), nil)
-	if err != nil {
-		return Pin{}, errors.New("unable to construct pin request")
-	}
-	addHeaders(req)
+	// Not retried, as a failed attempt may still have created a PIN, and Plex
+	// limits how many can be created
 	var pinResp Pin
-	err = doReq(logger, req, &pinResp)
+	_, err := p.attempt(ctx, logger, "POST", pinPath+"?"+q.Encode(), "", plexXML, &pinResp)
 	if err != nil {
 		return Pin{}, err
 	}
@@ -110,26 +368,19 @@ func GetPin(logger *logrus.Entry) (Pin, error) {
 }
 
 // GetLoginURL Construct a login URL for authenticating with Plex
-func GetLoginURL(redirectURI, code string) string {
+func (p *HTTPPlexClient) GetLoginURL(redirectURI, code string) string {
 	// Can't use url.Parse here, since Plex API wants a leading fragment for some reason
 	q := url.Values{}
-	q.Set("clientID", config.ClientIdentifier)
+	q.Set("clientID", p.config.ClientIdentifier)
 	q.Set("code", code)
 	q.Set("forwardUrl", redirectURI)
-	return fmt.Sprintf("%s?%s", loginURL, q.Encode())
+	return fmt.Sprintf("%s?%s", p.LoginURL, q.Encode())
 }
 
 // GetToken Retrieve an authentication Token using a Pin
-func GetToken(logger *logrus.Entry, pinId string) (string, error) {
-	pinUrl, _ := url.Parse(pinURL)
-	pinUrl.Path += fmt.Sprintf("/%s", pinId)
-	req, err := http.NewRequest("GET", pinUrl.String(), nil)
-	if err != nil {
-		return "", errors.New("unable to construct pin request")
-	}
-	addHeaders(req)
+func (p *HTTPPlexClient) GetToken(ctx context.Context, logger *logrus.Entry, pinId string) (string, error) {
 	var pin Pin
-	err = doReq(logger, req, &pin)
+	err := p.doReq(ctx, logger, "GET", pinPath+"/"+url.PathEscape(pinId), "", plexXML, &pin)
 	if err != nil {
 		return "", err
 	}
@@ -138,16 +389,13 @@ func GetToken(logger *logrus.Entry, pinId string) (string, error) {
 }
 
 // GetUser Retrieve an authenticated User
-func GetUser(logger *logrus.Entry, token string) (User, error) {
-	userUrl, _ := url.Parse(userURL)
-	req, err := http.NewRequest("GET", userUrl.String(), nil)
-	if err != nil {
-		return User{}, errors.New("unable to construct user request")
-	}
-	addHeaders(req)
-	addTokenHeader(req, token)
+func (p *HTTPPlexClient) GetUser(ctx context.Context, logger *logrus.Entry, token string) (User, error) {
 	var user User
-	err = doReq(logger, req, &user)
+	err := p.doReq(ctx, logger, "GET", userPath, token, plexJSON, &user)
+	if p.fallback(ctx, logger, err) {
+		user = User{}
+		err = p.doReq(ctx, logger, "GET", legacyUserPath, token, plexXML, &user)
+	}
 	if err != nil {
 		return User{}, err
 	}
@@ -155,34 +403,83 @@ func GetUser(logger *logrus.Entry, token string) (User, error) {
 	return user, nil
 }
 
-// GetAccessTier Retrieve the access tier of this user on a configured server
-func GetAccessTier(logger *logrus.Entry, token string) (AccessTier, error) {
-	resourcesUrl, _ := url.Parse(resourcesURL)
-	req, err := http.NewRequest("GET", resourcesUrl.String(), nil)
-	if err != nil {
-		return NoAccess, errors.New("unable to construct resources request")
+// GetAccessTier Retrieve the access tier of this user on the given server
+func (p *HTTPPlexClient) GetAccessTier(ctx context.Context, logger *logrus.Entry, token, serverIdentifier string) (AccessTier, error) {
+	var resources []Resource
+	err := p.doReq(ctx, logger, "GET", resourcesPath, token, plexJSON, &resources)
+	if err == nil {
+		for _, resource := range resources {
+			if resource.ClientIdentifier == serverIdentifier {
+				return accessTier(resource.Owned, resource.Home), nil
+			}
+		}
+		return NoAccess, nil
+	}
+
+	if !p.fallback(ctx, logger, err) {
+		return NoAccess, err
 	}
-	addHeaders(req)
-	addTokenHeader(req, token)
-	var resources Resources
-	err = doReq(logger, req, &resources)
+	var legacy Resources
+	err = p.doReq(ctx, logger, "GET", legacyResourcesPath, token, plexXML, &legacy)
 	if err != nil {
 		return NoAccess, err
 	}
 
-	for _, device := range resources.Devices {
-		if device.ClientIdentifier == config.ServerIdentifier {
-			if device.Owned == "1" {
-				return Owner, nil
-			}
+	for _, device := range legacy.Devices {
+		if device.ClientIdentifier == serverIdentifier {
+			return accessTier(device.Owned == "1", device.Home == "1"), nil
+		}
+	}
 
-			if device.Home == "1" {
-				return HomeUser, nil
-			}
+	return NoAccess, nil
+}
+
+// Whether to retry a failed request to the v2 API with the legacy XML API.
+// Not if the token was rejected, as the legacy API would too, or the caller
+// has given up
+func (p *HTTPPlexClient) fallback(ctx context.Context, logger *logrus.Entry, err error) bool {
+	if err == nil || errors.Is(err, ErrPlexUnauthorized) || ctx.Err() != nil {
+		return false
+	}
+
+	logger.WithField("error", err).Warn("Error from Plex v2 API, falling back to legacy API")
+	return true
+}
 
-			return NormalUser, nil
+// Get the access tier of a user on a server they own, or are a member of
+func accessTier(owned, home bool) AccessTier {
+	if owned {
+		return Owner
+	}
+
+	if home {
+		return HomeUser
+	}
+
+	return NormalUser
+}
+
+// RevokeToken Remove this service from the User's authorized devices, which
+// revokes the token along with any others issued to this service for the User
+func (p *HTTPPlexClient) RevokeToken(ctx context.Context, logger *logrus.Entry, token string) error {
+	var devices Devices
+	err := p.doReq(ctx, logger, "GET", devicesPath, token, plexXML, &devices)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices.Devices {
+		if device.ClientIdentifier != p.config.ClientIdentifier {
+			continue
+		}
+
+		err = p.doReq(ctx, logger, "DELETE", fmt.Sprintf(devicePath, url.PathEscape(device.Id)), token, plexXML, nil)
+		if errors.Is(err, ErrPlexNotFound) {
+			return nil
 		}
+		return err
 	}
 
-	return NoAccess, nil
+	// Already revoked
+	return nil
 }
@@ -0,0 +1,284 @@
+package tfaps
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestPlexAddHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	setTestConfig([]string{
+		"--client-identifier=client",
+		"--plex-device-name=Forward Auth",
+		"--plex-platform=Linux",
+		"--plex-version=1.2.3",
+	})
+	req := httptest.NewRequest("GET", "https://plex.tv/users/account", nil)
+	addHeaders(config, req)
+
+	assert.Equal("traefik-forward-auth-plex-sso", req.Header.Get("X-Plex-Product"))
+	assert.Equal("client", req.Header.Get("X-Plex-Client-Identifier"))
+	assert.Equal("Forward Auth", req.Header.Get("X-Plex-Device-Name"))
+	assert.Equal("Linux", req.Header.Get("X-Plex-Platform"))
+	assert.Equal("1.2.3", req.Header.Get("X-Plex-Version"))
+
+	// Should omit headers that aren't set
+	_, ok := req.Header["X-Plex-Device"]
+	assert.False(ok)
+	_, ok = req.Header["X-Plex-Model"]
+	assert.False(ok)
+}
+
+func TestPlexClientRequests(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setTestConfig([]string{
+		"--client-identifier=client",
+		"--server-identifier=server",
+	})
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+
+	var paths []string
+	plex := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		assert.Equal("client", r.Header.Get("X-Plex-Client-Identifier"))
+
+		switch r.URL.Path {
+		case "/api/v2/pins":
+			assert.Equal("true", r.URL.Query().Get("strong"))
+			fmt.Fprint(w, `<pin id="1" code="abcd"/>`)
+		case "/api/v2/pins/1":
+			fmt.Fprint(w, `<pin id="1" code="abcd" authToken="token"/>`)
+		case "/api/v2/user":
+			assert.Equal("token", r.Header.Get("X-Plex-Token"))
+			assert.Equal("application/json", r.Header.Get("Accept"))
+			fmt.Fprint(w, `{"id": 1, "uuid": "abc123", "username": "test", "title": "Test User", "email": "test@test.com",
+				"thumb": "https://plex.tv/users/abc123/avatar", "home": true, "restricted": false,
+				"subscription": {"active": true, "status": "Active", "plan": "lifetime"}}`)
+		case "/api/v2/resources":
+			fmt.Fprint(w, `[{"clientIdentifier": "other", "owned": true}, {"clientIdentifier": "server", "owned": false, "home": true}]`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer plex.Close()
+
+	p := NewPlexClient(config)
+	p.URL = plex.URL
+
+	pin, err := p.GetPin(context.Background(), logger)
+	require.Nil(err)
+	assert.Equal("abcd", pin.Code)
+
+	token, err := p.GetToken(context.Background(), logger, pin.Id)
+	require.Nil(err)
+	assert.Equal("token", token)
+
+	user, err := p.GetUser(context.Background(), logger, token)
+	require.Nil(err)
+	assert.Equal(User{
+		Id:           1,
+		UUID:         "abc123",
+		Username:     "test",
+		Title:        "Test User",
+		Email:        "test@test.com",
+		Thumb:        "https://plex.tv/users/abc123/avatar",
+		Home:         true,
+		Subscription: Subscription{Active: true, Status: "Active", Plan: "lifetime"},
+	}, user)
+
+	tier, err := p.GetAccessTier(context.Background(), logger, token, "server")
+	require.Nil(err)
+	assert.Equal(HomeUser, tier)
+
+	assert.Equal([]string{
+		"POST /api/v2/pins",
+		"GET /api/v2/pins/1",
+		"GET /api/v2/user",
+		"GET /api/v2/resources",
+	}, paths)
+
+	// Should keep the identity the client was created with
+	setTestConfig([]string{"--client-identifier=reloaded"})
+	paths = nil
+	_, err = p.GetToken(context.Background(), logger, pin.Id)
+	require.Nil(err)
+
+	// Login url should use the configured page
+	p.LoginURL = "https://login.example.com/#!"
+	assert.Equal("https://login.example.com/#!?clientID=client&code=abcd&forwardUrl=https%3A%2F%2Fauth.example.com%2F_oauth",
+		p.GetLoginURL("https://auth.example.com/_oauth", "abcd"))
+}
+
+func TestPlexClientLegacyFallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	setTestConfig([]string{"--server-identifier=server"})
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+
+	var paths []string
+	v2Status := 404
+	plex := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/users/account":
+			fmt.Fprint(w, `<user id="1" uuid="abc123" username="test" title="Test User" email="test@test.com" home="1" restricted="0">
+				<subscription active="1" status="Active" plan="yearly"/>
+			</user>`)
+		case "/api/resources":
+			fmt.Fprint(w, `<MediaContainer><Device clientIdentifier="server" owned="1" home="1"/></MediaContainer>`)
+		default:
+			w.WriteHeader(v2Status)
+		}
+	}))
+	defer plex.Close()
+
+	p := NewPlexClient(config)
+	p.URL = plex.URL
+	p.Retries = 0
+
+	// Should fall back to the xml endpoints
+	user, err := p.GetUser(context.Background(), logger, "token")
+	require.Nil(err)
+	assert.Equal("abc123", user.UUID)
+	assert.Equal("Test User", user.Title)
+	assert.Equal(Subscription{Active: true, Status: "Active", Plan: "yearly"}, user.Subscription)
+
+	tier, err := p.GetAccessTier(context.Background(), logger, "token", "server")
+	require.Nil(err)
+	assert.Equal(Owner, tier)
+	assert.Equal([]string{"/api/v2/user", "/users/account", "/api/v2/resources", "/api/resources"}, paths)
+
+	// Should not fall back when the token is rejected
+	paths = nil
+	v2Status = 401
+	_, err = p.GetUser(context.Background(), logger, "token")
+	assert.ErrorIs(err, ErrPlexUnauthorized)
+	assert.Equal([]string{"/api/v2/user"}, paths)
+}
+
+func TestPlexClientRetries(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{})
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+
+	var statuses []int
+	plex := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == 429 {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(status)
+		if status == 200 {
+			fmt.Fprint(w, `<pin id="1" code="abcd" authToken="token"/>`)
+		}
+	}))
+	defer plex.Close()
+
+	p := NewPlexClient(config)
+	p.URL = plex.URL
+	p.Backoff = time.Millisecond
+
+	// Should retry server errors
+	statuses = []int{502, 500, 200}
+	token, err := p.GetToken(context.Background(), logger, "1")
+	assert.Nil(err)
+	assert.Equal("token", token)
+	assert.Len(statuses, 0)
+
+	// Should not retry creating pins, which may have been created
+	statuses = []int{502, 200}
+	_, err = p.GetPin(context.Background(), logger)
+	assert.NotNil(err)
+	assert.Len(statuses, 1)
+
+	// Should give up once retries run out
+	statuses = []int{503, 503, 503, 200}
+	_, err = p.GetToken(context.Background(), logger, "1")
+	var statusErr *PlexStatusError
+	if assert.ErrorAs(err, &statusErr) {
+		assert.Equal(503, statusErr.StatusCode)
+	}
+	assert.Len(statuses, 1)
+
+	// Should return typed errors, only retrying rate limits
+	statuses = []int{401}
+	_, err = p.GetToken(context.Background(), logger, "1")
+	assert.ErrorIs(err, ErrPlexUnauthorized)
+	assert.Len(statuses, 0)
+
+	statuses = []int{404}
+	_, err = p.GetToken(context.Background(), logger, "1")
+	assert.ErrorIs(err, ErrPlexNotFound)
+	assert.NotErrorIs(err, ErrPlexUnauthorized)
+
+	p.Retries = 0
+	statuses = []int{429}
+	_, err = p.GetToken(context.Background(), logger, "1")
+	assert.ErrorIs(err, ErrPlexRateLimited)
+
+	// Should wait as long as Plex asks when rate limited
+	p.Retries = 1
+	statuses = []int{429, 200}
+	start := time.Now()
+	_, err = p.GetToken(context.Background(), logger, "1")
+	assert.Nil(err)
+	assert.GreaterOrEqual(time.Since(start), time.Second)
+}
+
+func TestPlexClientTimeout(t *testing.T) {
+	assert := assert.New(t)
+	setTestConfig([]string{})
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+
+	release := make(chan struct{})
+	var requests int32
+	plex := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer plex.Close()
+	defer close(release)
+
+	p := NewPlexClient(config)
+	p.URL = plex.URL
+	p.Timeout = 10 * time.Millisecond
+	p.Backoff = time.Millisecond
+
+	// Should retry each attempt that times out
+	_, err := p.GetToken(context.Background(), logger, "1")
+	assert.NotNil(err)
+	assert.Equal(int32(3), atomic.LoadInt32(&requests))
+
+	// Should stop when the caller's context is cancelled
+	atomic.StoreInt32(&requests, 0)
+	p.Timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = p.GetToken(ctx, logger, "1")
+	assert.ErrorIs(err, context.Canceled)
+	assert.Equal(int32(1), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,193 @@
+package tfaps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+type plexCacheEntry struct {
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// PlexCacheStats counts how often users and access tiers were found in the
+// cache, rather than requested from Plex
+type PlexCacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
+
+// cachingPlexClient caches the users and access tiers Plex returns, keyed by
+// a hash of the token, so a burst of logins or API requests for the same user
+// only calls Plex once. Tokens Plex rejects are cached too, so an API client
+// with a revoked token can't make a call to Plex for every request.
+// Concurrent identical requests are also only made once, whether or not
+// caching is enabled
+type cachingPlexClient struct {
+	PlexClient
+	ttl   time.Duration
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]plexCacheEntry
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newCachingPlexClient(plex PlexClient, ttl time.Duration) *cachingPlexClient {
+	return &cachingPlexClient{
+		PlexClient: plex,
+		ttl:        ttl,
+		entries:    map[string]plexCacheEntry{},
+	}
+}
+
+// GetToken Retrieve an authentication Token using a Pin, once for concurrent
+// requests for the same Pin
+func (p *cachingPlexClient) GetToken(ctx context.Context, logger *logrus.Entry, pinId string) (string, error) {
+	token, err := p.do(ctx, "token:"+pinId, false, func(ctx context.Context) (interface{}, error) {
+		return p.PlexClient.GetToken(ctx, logger, pinId)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token.(string), nil
+}
+
+// GetUser Retrieve an authenticated User, from the cache if possible
+func (p *cachingPlexClient) GetUser(ctx context.Context, logger *logrus.Entry, token string) (User, error) {
+	user, err := p.do(ctx, "user:"+SessionKey(token), true, func(ctx context.Context) (interface{}, error) {
+		return p.PlexClient.GetUser(ctx, logger, token)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user.(User), nil
+}
+
+// GetAccessTier Retrieve the access tier of this user on the given server,
+// from the cache if possible
+func (p *cachingPlexClient) GetAccessTier(ctx context.Context, logger *logrus.Entry, token, serverIdentifier string) (AccessTier, error) {
+	key := "tier:" + serverIdentifier + ":" + SessionKey(token)
+	tier, err := p.do(ctx, key, true, func(ctx context.Context) (interface{}, error) {
+		return p.PlexClient.GetAccessTier(ctx, logger, token, serverIdentifier)
+	})
+	if err != nil {
+		return NoAccess, err
+	}
+	return tier.(AccessTier), nil
+}
+
+// Get a cached result, or call fn once for all concurrent callers with the
+// same key. Errors other than Plex rejecting the token aren't cached. fn isn't
+// cancelled if the caller that made the call gives up, as others may be
+// waiting for it
+func (p *cachingPlexClient) do(ctx context.Context, key string, cache bool, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if cache && p.ttl > 0 {
+		if entry, ok := p.get(key); ok {
+			p.hits.Add(1)
+			return entry.value, entry.err
+		}
+		p.misses.Add(1)
+	}
+
+	ch := p.group.DoChan(key, func() (interface{}, error) {
+		value, err := fn(context.WithoutCancel(ctx))
+		if (err == nil || errors.Is(err, ErrPlexUnauthorized)) && cache && p.ttl > 0 {
+			p.set(key, value, err)
+		}
+		return value, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.Val, res.Err
+	}
+}
+
+func (p *cachingPlexClient) get(key string) (plexCacheEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[key]
+	if !ok || entry.expires.Before(time.Now()) {
+		return plexCacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+func (p *cachingPlexClient) set(key string, value interface{}, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries[key] = plexCacheEntry{value: value, err: err, expires: time.Now().Add(p.ttl)}
+}
+
+// Remove expired entries
+func (p *cachingPlexClient) prune() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range p.entries {
+		if entry.expires.Before(now) {
+			delete(p.entries, key)
+		}
+	}
+}
+
+// Stats returns the cache hit and miss counts since startup
+func (p *cachingPlexClient) Stats() PlexCacheStats {
+	p.mu.Lock()
+	entries := len(p.entries)
+	p.mu.Unlock()
+
+	return PlexCacheStats{
+		Hits:    p.hits.Load(),
+		Misses:  p.misses.Load(),
+		Entries: entries,
+	}
+}
+
+// Remove expired entries from the Plex cache, and log the cache stats
+func (s *Server) prunePlexCache() {
+	s.plexCache.prune()
+
+	stats := s.plexCache.Stats()
+	log.WithFields(logrus.Fields{
+		"hits":    stats.Hits,
+		"misses":  stats.Misses,
+		"entries": stats.Entries,
+	}).Debug("Plex cache stats")
+}
+
+// PlexCacheHandler reports the Plex cache stats, for session admins
+func (s *Server) PlexCacheHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "PlexCache", "default", "Reporting plex cache stats")
+		if !s.authorizeSessionAdmin(cfg, logger, w, r) {
+			return
+		}
+
+		var stats PlexCacheStats
+		if s.plexCache != nil {
+			stats = s.plexCache.Stats()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,144 @@
+package tfaps
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// Plex client counting calls, which block until released
+type countingPlexClient struct {
+	PlexClient
+	calls   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (p *countingPlexClient) GetUser(ctx context.Context, logger *logrus.Entry, token string) (User, error) {
+	p.calls.Add(1)
+	if p.release != nil {
+		<-p.release
+	}
+	return User{Email: token + "@test.com"}, p.err
+}
+
+func (p *countingPlexClient) GetAccessTier(ctx context.Context, logger *logrus.Entry, token, serverIdentifier string) (AccessTier, error) {
+	p.calls.Add(1)
+	return HomeUser, p.err
+}
+
+/**
+ * Tests
+ */
+
+func TestPlexCacheCaches(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+	setTestConfig([]string{})
+
+	plex := &countingPlexClient{}
+	cache := newCachingPlexClient(plex, time.Minute)
+
+	// Should only call plex once per token
+	for i := 0; i < 3; i++ {
+		user, err := cache.GetUser(context.Background(), logger, "a")
+		assert.Nil(err)
+		assert.Equal("a@test.com", user.Email)
+	}
+	tier, err := cache.GetAccessTier(context.Background(), logger, "a", "server")
+	assert.Nil(err)
+	assert.Equal(HomeUser, tier)
+	_, err = cache.GetUser(context.Background(), logger, "b")
+	assert.Nil(err)
+
+	assert.Equal(int32(3), plex.calls.Load())
+	assert.Equal(PlexCacheStats{Hits: 2, Misses: 3, Entries: 3}, cache.Stats())
+
+	// Should not cache errors
+	plex.err = errors.New("unavailable")
+	_, err = cache.GetUser(context.Background(), logger, "c")
+	assert.NotNil(err)
+	plex.err = nil
+	_, err = cache.GetUser(context.Background(), logger, "c")
+	assert.Nil(err)
+	assert.Equal(int32(5), plex.calls.Load())
+
+	// Should cache tokens Plex rejects
+	plex.err = ErrPlexUnauthorized
+	_, err = cache.GetUser(context.Background(), logger, "d")
+	assert.ErrorIs(err, ErrPlexUnauthorized)
+	plex.err = nil
+	_, err = cache.GetUser(context.Background(), logger, "d")
+	assert.ErrorIs(err, ErrPlexUnauthorized)
+	assert.Equal(int32(6), plex.calls.Load())
+
+	// Should not cache access tier across servers
+	_, err = cache.GetAccessTier(context.Background(), logger, "a", "other")
+	assert.Nil(err)
+	assert.Equal(int32(7), plex.calls.Load())
+
+	// Should expire entries
+	cache.ttl = -time.Minute
+	cache.set("expired", User{}, nil)
+	_, ok := cache.get("expired")
+	assert.False(ok)
+	cache.prune()
+	assert.NotContains(cache.entries, "expired")
+
+	// Should not cache when disabled
+	plex.calls.Store(0)
+	cache = newCachingPlexClient(plex, 0)
+	cache.GetUser(context.Background(), logger, "a")
+	cache.GetUser(context.Background(), logger, "a")
+	assert.Equal(int32(2), plex.calls.Load())
+	assert.Equal(PlexCacheStats{}, cache.Stats())
+}
+
+func TestPlexCacheSingleflight(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+	setTestConfig([]string{})
+
+	plex := &countingPlexClient{release: make(chan struct{})}
+	cache := newCachingPlexClient(plex, 0)
+
+	// Concurrent requests for the same token should share a call
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, _ := cache.GetUser(context.Background(), logger, "a")
+			results[i] = user.Email
+		}()
+	}
+
+	// A caller giving up shouldn't affect the others
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := cache.GetUser(ctx, logger, "a")
+		cancelled <- err
+	}()
+	cancel()
+	assert.ErrorIs(<-cancelled, context.Canceled)
+
+	time.Sleep(10 * time.Millisecond)
+	close(plex.release)
+	wg.Wait()
+
+	assert.Equal(int32(1), plex.calls.Load())
+	for _, email := range results {
+		assert.Equal("a@test.com", email)
+	}
+}
@@ -0,0 +1,186 @@
+package tfaps
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Errors returned when re-verifying the access tier of a session
+var (
+	// ErrAccessRevoked is returned when the user no longer has access to the
+	// configured server
+	ErrAccessRevoked = errors.New("access to server has been revoked")
+
+	// ErrRecheckUnavailable is returned when Plex can't be reached to verify the
+	// access tier, and the grace period has passed
+	ErrRecheckUnavailable = errors.New("unable to verify access tier")
+
+	// ErrRecheckNoToken is returned when the session holds no Plex token to
+	// verify the access tier with
+	ErrRecheckNoToken = errors.New("session has no plex token")
+)
+
+// Minimum time between attempts to verify an access tier while Plex can't be
+// reached, so an outage doesn't result in a request to Plex for every request
+const recheckRetryInterval = time.Minute
+
+type tierCheck struct {
+	tier      AccessTier
+	checkedAt time.Time
+	attemptAt time.Time
+}
+
+// tierCheckCache holds the results of re-verifying access tiers, keyed by
+// session token, so that stateless sessions don't need to be re-issued
+type tierCheckCache struct {
+	mu     sync.Mutex
+	checks map[string]tierCheck
+}
+
+func newTierCheckCache() *tierCheckCache {
+	return &tierCheckCache{
+		checks: map[string]tierCheck{},
+	}
+}
+
+func (t *tierCheckCache) get(key string) tierCheck {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.checks[key]
+}
+
+func (t *tierCheckCache) attempt(key string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	check := t.checks[key]
+	check.attemptAt = at
+	t.checks[key] = check
+}
+
+func (t *tierCheckCache) set(key string, tier AccessTier, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.checks[key] = tierCheck{tier: tier, checkedAt: at, attemptAt: at}
+}
+
+// Remove checks that were last attempted before the given time
+func (t *tierCheckCache) prune(before time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, check := range t.checks {
+		if check.attemptAt.Before(before) {
+			delete(t.checks, key)
+		}
+	}
+}
+
+// Re-verify the access tier of a session with Plex once the "recheck-interval"
+// has passed since it was last verified. If Plex can't be reached the last
+// known tier is trusted until the "recheck-grace" period has also passed
+func (s *Server) recheckAccessTier(ctx context.Context, cfg *Config, logger *logrus.Entry, c *http.Cookie, claims Claims) (Claims, error) {
+	if cfg.RecheckInterval == 0 {
+		return claims, nil
+	}
+
+	checkedAt := time.Unix(claims.CheckedAt, 0)
+	if claims.CheckedAt == 0 {
+		checkedAt = time.Unix(claims.IssuedAt, 0)
+	}
+
+	// Sessions issued before rechecks were enabled have to log in again
+	if len(claims.Token) == 0 {
+		if time.Since(checkedAt) >= cfg.RecheckInterval {
+			return claims, ErrRecheckNoToken
+		}
+		return claims, nil
+	}
+
+	// Use the latest result for stateless sessions
+	key := SessionKey(claims.Token)
+	check := s.tierChecks.get(key)
+	if check.checkedAt.After(checkedAt) {
+		claims.Tier = check.tier
+		claims.CheckedAt = check.checkedAt.Unix()
+		checkedAt = check.checkedAt
+
+		// Access was revoked by an earlier recheck, and the client has sent
+		// the cookie again
+		if check.tier == NoAccess {
+			return claims, ErrAccessRevoked
+		}
+	}
+
+	// Is a recheck due?
+	if time.Since(checkedAt) < cfg.RecheckInterval {
+		return claims, nil
+	}
+	inGrace := time.Since(checkedAt) < cfg.RecheckInterval+cfg.RecheckGrace
+
+	// Has a recheck just failed?
+	if time.Since(check.attemptAt) < recheckRetryInterval {
+		if inGrace {
+			return claims, nil
+		}
+		return claims, ErrRecheckUnavailable
+	}
+
+	token, err := OpenToken(cfg, claims.Token)
+	if err != nil {
+		logger.WithField("error", err).Warn("Unable to read session plex token")
+		return claims, ErrRecheckNoToken
+	}
+
+	now := time.Now()
+	s.tierChecks.attempt(key, now)
+	tier, err := s.plex.GetAccessTier(ctx, logger, token, cfg.ServerIdentifier)
+	if errors.Is(err, ErrPlexUnauthorized) {
+		// The token has been revoked, so the user needs to log in again. This
+		// isn't an outage, so don't trust the last known tier meanwhile
+		logger.WithField("error", err).Info("Plex token is no longer valid")
+		s.tierChecks.attempt(key, time.Time{})
+		return claims, ErrRecheckNoToken
+	}
+	if err != nil {
+		if inGrace {
+			logger.WithField("error", err).Warn("Unable to re-verify access tier, using last known tier")
+			return claims, nil
+		}
+		logger.WithField("error", err).Error("Unable to re-verify access tier")
+		return claims, ErrRecheckUnavailable
+	}
+	s.tierChecks.set(key, tier, now)
+
+	if tier != claims.Tier {
+		logger.WithFields(logrus.Fields{
+			"email":            Sanitize(claims.Email),
+			"access_tier":      tier,
+			"prev_access_tier": claims.Tier,
+		}).Info("Access tier changed")
+	}
+	claims.Tier = tier
+	claims.CheckedAt = now.Unix()
+
+	if tier == NoAccess {
+		return claims, ErrAccessRevoked
+	}
+
+	// Update the stored session
+	if s.sessions != nil {
+		err = s.sessions.Save(SessionKey(c.Value), claims)
+		if err != nil {
+			logger.WithField("error", err).Error("Error updating session")
+		}
+	}
+
+	return claims, nil
+}
+
+// Remove tier checks for sessions that have expired
+func (s *Server) pruneTierChecks() {
+	s.tierChecks.prune(time.Now().Add(-currentConfig().Lifetime))
+}
@@ -0,0 +1,136 @@
+package tfaps
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Plex client returning a fixed access tier
+type tierPlexClient struct {
+	PlexClient
+	tier  AccessTier
+	calls int
+}
+
+func (p *tierPlexClient) GetAccessTier(ctx context.Context, logger *logrus.Entry, token, serverIdentifier string) (AccessTier, error) {
+	p.calls++
+	return p.tier, nil
+}
+
+/**
+ * Tests
+ */
+
+func TestRecheckAccessTier(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+	setTestConfig([]string{
+		"--secret=verysecret",
+		"--recheck-interval=600",
+		"--recheck-grace=3600",
+	})
+	s := &Server{tierChecks: newTierCheckCache()}
+	c := &http.Cookie{}
+
+	sealed, err := SealToken(config, "plextoken")
+	require.Nil(t, err)
+	claims := NewClaims(config, User{Email: "test@test.com"}, HomeUser)
+	claims.Token = sealed
+
+	// Should not recheck within interval
+	checked, err := s.recheckAccessTier(context.Background(), config, logger, c, claims)
+	assert.Nil(err)
+	assert.Equal(claims, checked)
+
+	// Should require token once due
+	due := claims
+	due.Token = ""
+	due.CheckedAt = time.Now().Add(-11 * time.Minute).Unix()
+	_, err = s.recheckAccessTier(context.Background(), config, logger, c, due)
+	assert.Equal(ErrRecheckNoToken, err)
+
+	due.Token = "notsealed"
+	_, err = s.recheckAccessTier(context.Background(), config, logger, c, due)
+	assert.Equal(ErrRecheckNoToken, err)
+
+	// Should use newer result of a recheck
+	due.Token = sealed
+	now := time.Now()
+	s.tierChecks.set(SessionKey(sealed), NormalUser, now)
+	checked, err = s.recheckAccessTier(context.Background(), config, logger, c, due)
+	assert.Nil(err)
+	assert.Equal(NormalUser, checked.Tier, "should downgrade to rechecked tier")
+	assert.Equal(now.Unix(), checked.CheckedAt)
+
+	// Should trust last known tier within grace period after a failed attempt
+	s.tierChecks = newTierCheckCache()
+	s.tierChecks.attempt(SessionKey(sealed), time.Now())
+	checked, err = s.recheckAccessTier(context.Background(), config, logger, c, due)
+	assert.Nil(err)
+	assert.Equal(HomeUser, checked.Tier)
+
+	// Should fail once grace period has passed
+	due.CheckedAt = time.Now().Add(-2 * time.Hour).Unix()
+	_, err = s.recheckAccessTier(context.Background(), config, logger, c, due)
+	assert.Equal(ErrRecheckUnavailable, err)
+
+	// Should not recheck when disabled
+	config.RecheckInterval = 0
+	checked, err = s.recheckAccessTier(context.Background(), config, logger, c, due)
+	assert.Nil(err)
+	assert.Equal(due, checked)
+}
+
+func TestRecheckRevokedSession(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{
+		"--secret=verysecret",
+		"--server-identifier=server",
+		"--recheck-interval=600",
+	})
+	plex := &tierPlexClient{tier: NoAccess}
+	s := NewServerWithPlexClient(plex)
+	t.Cleanup(s.Close)
+
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/")
+	sealed, err := SealToken(config, "plextoken")
+	require.Nil(t, err)
+	claims := NewClaims(config, User{Email: "test@test.com"}, HomeUser)
+	claims.Token = sealed
+	claims.CheckedAt = time.Now().Add(-11 * time.Minute).Unix()
+	c := mustMakeCookie(t, r, claims)
+	r.AddCookie(c)
+
+	// Should keep refusing the cookie once access is revoked
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		assert.Equal(401, w.Code, "request %d", i+1)
+	}
+	assert.Equal(1, plex.calls, "should use the result of the first recheck")
+}
+
+func TestRecheckPrune(t *testing.T) {
+	assert := assert.New(t)
+	cache := newTierCheckCache()
+
+	cache.set("old", Owner, time.Now().Add(-2*time.Hour))
+	cache.set("new", Owner, time.Now())
+	cache.prune(time.Now().Add(-time.Hour))
+
+	assert.Equal(tierCheck{}, cache.get("old"), "old check should be pruned")
+	assert.Equal(Owner, cache.get("new").tier, "new check should be kept")
+}
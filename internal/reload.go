@@ -0,0 +1,152 @@
+package tfaps
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often config files are checked for changes when "watch-config" is set
+const configWatchInterval = 5 * time.Second
+
+// Reload re-parses the config from the given command arguments and, if it's
+// valid, replaces the current config and rules. If it isn't, the current config
+// is kept and an error returned
+func (s *Server) Reload(args []string) error {
+	old := currentConfig()
+
+	c, err := NewConfig(args)
+	if err != nil {
+		log.WithField("error", err).Error("Error reloading config, keeping current config")
+		return err
+	}
+
+	// Keep the identity we've registered with Plex, unless it's configured
+	if len(c.ClientIdentifierString) == 0 {
+		c.ClientIdentifier = old.ClientIdentifier
+	}
+
+	err = errors.Join(c.validate()...)
+	if err != nil {
+		log.WithField("error", err).Error("Invalid config, keeping current config")
+		return err
+	}
+
+	c.jwtKeys, err = LoadJWTKeys(c.JWTKeys)
+	if err != nil {
+		log.WithField("error", err).Error("Invalid config, keeping current config")
+		return err
+	}
+
+	muxer, err := s.newMuxer(c, s.ruleHandler, nil)
+	if err != nil {
+		log.WithField("error", err).Error("Invalid config, keeping current config")
+		return err
+	}
+
+	// Some options are only used on startup
+	for option, changed := range map[string]bool{
+		"port":                  c.Port != old.Port,
+		"session-store":         c.SessionStore != old.SessionStore,
+		"session-store-path":    c.SessionStorePath != old.SessionStorePath,
+		"recheck-interval":      (c.RecheckInterval > 0) != (old.RecheckInterval > 0),
+		"token-auth":            c.TokenAuth != old.TokenAuth,
+		"plex-url":              c.PlexURL != old.PlexURL,
+		"plex-login-url":        c.PlexLoginURL != old.PlexLoginURL,
+		"plex-timeout":          c.PlexTimeout != old.PlexTimeout,
+		"plex-retries":          c.PlexRetries != old.PlexRetries,
+		"plex-cache-ttl":        c.PlexCacheTTL != old.PlexCacheTTL,
+		"client-identifier":     c.ClientIdentifier != old.ClientIdentifier,
+		"product":               c.Product != old.Product,
+		"plex-device":           c.PlexDevice != old.PlexDevice,
+		"plex-device-name":      c.PlexDeviceName != old.PlexDeviceName,
+		"plex-model":            c.PlexModel != old.PlexModel,
+		"plex-platform":         c.PlexPlatform != old.PlexPlatform,
+		"plex-platform-version": c.PlexPlatformVersion != old.PlexPlatformVersion,
+		"plex-version":          c.PlexVersion != old.PlexVersion,
+	} {
+		if changed {
+			log.WithField("option", option).Warn("Option changed, restart required for it to take effect")
+		}
+	}
+
+	// Swap everything at once. Handlers use the config the muxer was built
+	// from, so no request sees a mix of old and new
+	configMu.Lock()
+	config = c
+	s.muxer = muxer
+	configMu.Unlock()
+
+	NewDefaultLogger()
+	c.logStateSecretCreated()
+	c.logRuleFileErrors()
+	c.logRuleEnvSkipped()
+	logRules(c)
+	log.Info("Reloaded config")
+
+	return nil
+}
+
+// WatchConfig reloads the config whenever one of the config files it was read
+// from, if "watch-config" is set, or the rules dir changes, until the server
+// is closed
+func (s *Server) WatchConfig(args []string) {
+	state := configFilesState(currentConfig().watchedFiles())
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		files := currentConfig().watchedFiles()
+		latest := configFilesState(files)
+		if maps.Equal(latest, state) {
+			continue
+		}
+		state = latest
+
+		log.WithField("files", files).Info("Config file changed, reloading")
+		s.Reload(args)
+	}
+}
+
+// Get the files to watch for changes
+func (c *Config) watchedFiles() []string {
+	var files []string
+	if c.WatchConfig {
+		files = append(files, c.files...)
+	}
+	if len(c.RulesDir) > 0 {
+		// The dir changes when files are added or removed
+		files = append(files, c.RulesDir)
+		files = append(files, c.ruleFiles...)
+	}
+
+	return files
+}
+
+// Get the modification time of each of the given files
+func configFilesState(files []string) map[string]time.Time {
+	state := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"error": err,
+				"file":  file,
+			}).Warn("Unable to check config file for changes")
+			continue
+		}
+		state[file] = info.ModTime()
+	}
+
+	return state
+}
@@ -0,0 +1,131 @@
+package tfaps
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	log, _ = test.NewNullLogger()
+
+	request := func(s *Server, uri string) int {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		r.Header.Set("Cookie", currentConfig().CookieName+"=invalid")
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w.Code
+	}
+
+	path := filepath.Join(t.TempDir(), "config.ini")
+	args := []string{"--config=" + path}
+	writeConfig := func(content string) {
+		err := os.WriteFile(path, []byte("secret=test\n"+content), 0600)
+		require.Nil(err)
+	}
+
+	writeConfig("whitelist=one@example.com\n")
+	setTestConfig(args)
+	s := NewServer()
+	t.Cleanup(s.Close)
+	clientIdentifier := config.ClientIdentifier
+	assert.Equal(401, request(s, "/public"))
+
+	// Should swap the lists and rules
+	writeConfig("whitelist=two@example.com\nrule.public.action=allow\nrule.public.rule=PathPrefix(`/public`)\n")
+	err := s.Reload(args)
+	require.Nil(err)
+	log, _ = test.NewNullLogger()
+	assert.Equal(CommaSeparatedList{"two@example.com"}, currentConfig().Whitelist)
+	assert.Equal(200, request(s, "/public"))
+	assert.Equal(401, request(s, "/private"))
+
+	// Should keep the client identifier
+	assert.Equal(clientIdentifier, currentConfig().ClientIdentifier)
+
+	// Requests in progress should keep using the config they started with
+	inProgress := s.muxer
+	writeConfig("logout-redirect=https://example.com/bye\n")
+	err = s.Reload(args)
+	require.Nil(err)
+	log, _ = test.NewNullLogger()
+	w := httptest.NewRecorder()
+	inProgress.ServeHTTP(w, httptest.NewRequest("GET", "http://app.example.com/_oauth/logout", nil))
+	assert.Equal(401, w.Code)
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/_oauth/logout")
+	s.RootHandler(w, r)
+	assert.Equal(307, w.Code)
+	writeConfig("whitelist=two@example.com\nrule.public.action=allow\nrule.public.rule=PathPrefix(`/public`)\n")
+	err = s.Reload(args)
+	require.Nil(err)
+
+	// Should keep the current config if the new one is invalid
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	writeConfig("whitelist=three@example.com\nrule.public.action=allow\nrule.public.rule=Bad(`/public`)\n")
+	err = s.Reload(args)
+	assert.NotNil(err)
+	assert.Equal(CommaSeparatedList{"two@example.com"}, currentConfig().Whitelist)
+	assert.Equal(200, request(s, "/public"))
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1) {
+		assert.Equal(logrus.ErrorLevel, logs[0].Level)
+		assert.Equal("Invalid config, keeping current config", logs[0].Message)
+	}
+}
+
+func TestReloadConfigFilesState(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+
+	dir := t.TempDir()
+	one := filepath.Join(dir, "one.ini")
+	two := filepath.Join(dir, "two.ini")
+	os.WriteFile(one, []byte("secret=test\n"), 0600)
+	os.WriteFile(two, []byte("secret=test\n"), 0600)
+
+	before := configFilesState([]string{one, two})
+	assert.Len(before, 2)
+
+	// Should pick up a change to any file, even to an earlier time
+	earlier := before[two].Add(-time.Minute)
+	os.Chtimes(two, earlier, earlier)
+	after := configFilesState([]string{one, two})
+	assert.Equal(before[one], after[one])
+	assert.True(after[two].Equal(earlier))
+
+	// Should ignore missing files
+	assert.Len(configFilesState([]string{one, two, filepath.Join(dir, "missing.ini")}), 2)
+}
+
+func TestReloadWatchedFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Config{files: []string{"/config.ini"}}
+	assert.Len(c.watchedFiles(), 0, "config files should only be watched with watch-config")
+
+	c.WatchConfig = true
+	assert.Equal([]string{"/config.ini"}, c.watchedFiles())
+
+	c.RulesDir = "/rules"
+	c.ruleFiles = []string{"/rules/a.ini"}
+	assert.Equal([]string{"/config.ini", "/rules", "/rules/a.ini"}, c.watchedFiles())
+}
@@ -0,0 +1,203 @@
+package tfaps
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load the rules from each file in the rules dir. Rules are named
+// "<name>@<file>", so rules in different files can't collide. A file with an
+// error is skipped, and the error kept to be reported, so it doesn't prevent
+// the other files from loading
+func (c *Config) loadRulesDir() error {
+	entries, err := os.ReadDir(c.RulesDir)
+	if err != nil {
+		return fmt.Errorf("unable to read rules dir: %v", err)
+	}
+
+	// Entries are sorted by filename
+	loaded := map[string]string{}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".ini" && ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		path := filepath.Join(c.RulesDir, entry.Name())
+		c.ruleFiles = append(c.ruleFiles, path)
+
+		namespace := strings.TrimSuffix(entry.Name(), ext)
+		if other, ok := loaded[namespace]; ok {
+			c.ruleFileErrors = append(c.ruleFileErrors, fmt.Errorf("rule file %s: rule names would collide with %s", path, other))
+			continue
+		}
+
+		rules, err := loadRuleFile(path)
+		if err != nil {
+			c.ruleFileErrors = append(c.ruleFileErrors, fmt.Errorf("rule file %s: %v", path, err))
+			continue
+		}
+
+		loaded[namespace] = path
+		for name, rule := range rules {
+			c.Rules[name+"@"+namespace] = rule
+		}
+	}
+
+	return nil
+}
+
+// Log the errors loading rule files, these aren't fatal
+func (c *Config) logRuleFileErrors() {
+	for _, err := range c.ruleFileErrors {
+		log.WithField("error", err).Error("Skipping invalid rule file")
+	}
+}
+
+// RuleFileErrors returns the errors loading files in the rules dir
+func (c *Config) RuleFileErrors() []error {
+	return c.ruleFileErrors
+}
+
+// Load and validate the rules in a rule file
+func loadRuleFile(path string) (map[string]*Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var params map[string]map[string]string
+	if filepath.Ext(path) == ".ini" {
+		params, err = parseRuleIni(b)
+	} else {
+		params, err = parseRuleYAML(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Set params in the same way as "rule.<name>.<param>" options
+	c := &Config{Rules: map[string]*Rule{}}
+	for name, rule := range params {
+		if strings.ContainsAny(name, ".@") {
+			return nil, fmt.Errorf("invalid rule name \"%s\", must not contain \".\" or \"@\"", name)
+		}
+		for param, val := range rule {
+			// Templates are relative to the rule file
+			if param == "template" && !filepath.IsAbs(val) {
+				val = filepath.Join(filepath.Dir(path), val)
+			}
+			err = c.setRuleParam(name+"."+param, name, param, val)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range c.OrderedRules() {
+		rule := c.Rules[name]
+		err = rule.Validate()
+		if err == nil {
+			err = rule.Compile()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule \"%s\": %v", name, err)
+		}
+	}
+
+	return c.Rules, nil
+}
+
+// Parse an ini rule file, with a section per rule:
+//
+//	[admin]
+//	rule = Host(`app.example.com`) && PathPrefix(`/admin`)
+//	whitelist = alice@example.com,bob@example.com
+func parseRuleIni(b []byte) (map[string]map[string]string, error) {
+	params := map[string]map[string]string{}
+	var section map[string]string
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if len(name) == 0 {
+				return nil, fmt.Errorf("line %d: route name is required", n)
+			}
+			section = map[string]string{}
+			params[name] = section
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"<param> = <value>\"", n)
+		}
+		if section == nil {
+			return nil, fmt.Errorf("line %d: param outside of a [<name>] section", n)
+		}
+
+		val := strings.TrimSpace(parts[1])
+		if len(val) > 0 && val[0] == '"' {
+			var err error
+			val, err = strconv.Unquote(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		section[strings.TrimSpace(parts[0])] = val
+	}
+
+	return params, scanner.Err()
+}
+
+// Parse a yaml rule file, with a mapping per rule. Lists can be given as
+// sequences:
+//
+//	admin:
+//	  rule: Host(`app.example.com`) && PathPrefix(`/admin`)
+//	  whitelist:
+//	    - alice@example.com
+//	    - bob@example.com
+func parseRuleYAML(b []byte) (map[string]map[string]string, error) {
+	var doc map[string]map[string]interface{}
+	err := yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]map[string]string{}
+	for name, rule := range doc {
+		params[name] = map[string]string{}
+		for param, val := range rule {
+			switch val := val.(type) {
+			case []interface{}:
+				items := make([]string, len(val))
+				for i, item := range val {
+					items[i] = fmt.Sprint(item)
+				}
+				params[name][param] = strings.Join(items, ",")
+			case nil:
+				params[name][param] = ""
+			case map[string]interface{}:
+				return nil, fmt.Errorf("invalid route param \"%s.%s\", must be a value or list", name, param)
+			default:
+				params[name][param] = fmt.Sprint(val)
+			}
+		}
+	}
+
+	return params, nil
+}
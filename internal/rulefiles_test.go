@@ -0,0 +1,152 @@
+package tfaps
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestRuleFilesLoad(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		require.Nil(err)
+	}
+
+	write("media.ini", `
+; Media apps
+[admin]
+rule = Host(`+"`media.example.com`"+`) && PathPrefix(`+"`/admin`"+`)
+whitelist = alice@example.com,bob@example.com
+priority = 100
+
+[public]
+action = allow
+rule = "Host(`+"`media.example.com`"+`) && PathPrefix(`+"`/public`"+`)"
+`)
+	write("dash.yaml", `
+admin:
+  rule: Host(`+"`dash.example.com`"+`)
+  whitelist:
+    - carol@example.com
+    - dave@example.com
+  tier: owner
+`)
+	write("broken.yml", `
+admin:
+  action: nope
+  rule: Host(`+"`broken.example.com`"+`)
+`)
+	write("README.md", "ignored")
+
+	c, err := NewConfig([]string{
+		"--rules-dir=" + dir,
+		"--rule.admin.rule=Host(`app.example.com`)",
+	})
+	require.Nil(err)
+
+	// Rules should be namespaced by file
+	assert.Len(c.Rules, 4)
+	assert.Equal(&Rule{
+		Action: "auth",
+		Rule:   "Host(`app.example.com`)",
+	}, c.Rules["admin"])
+	assert.Equal(&Rule{
+		Action:    "auth",
+		Rule:      "Host(`media.example.com`) && PathPrefix(`/admin`)",
+		Priority:  100,
+		Whitelist: CommaSeparatedList{"alice@example.com", "bob@example.com"},
+	}, c.Rules["admin@media"])
+	assert.Equal(&Rule{
+		Action: "allow",
+		Rule:   "Host(`media.example.com`) && PathPrefix(`/public`)",
+	}, c.Rules["public@media"])
+	assert.Equal(&Rule{
+		Action:    "auth",
+		Rule:      "Host(`dash.example.com`)",
+		Whitelist: CommaSeparatedList{"carol@example.com", "dave@example.com"},
+		Tier:      Owner,
+	}, c.Rules["admin@dash"])
+
+	// Broken file should be reported, without affecting the others
+	errs := c.RuleFileErrors()
+	if assert.Len(errs, 1) {
+		assert.Contains(errs[0].Error(), "broken.yml")
+		assert.Contains(errs[0].Error(), "invalid rule action")
+	}
+	assert.Equal([]string{
+		filepath.Join(dir, "broken.yml"),
+		filepath.Join(dir, "dash.yaml"),
+		filepath.Join(dir, "media.ini"),
+	}, c.ruleFiles)
+
+	// Missing dir should be an error
+	_, err = NewConfig([]string{"--rules-dir=" + filepath.Join(dir, "missing")})
+	assert.NotNil(err)
+}
+
+func TestRuleFilesCollision(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "app.ini"), []byte("[one]\nrule = Host(`one.example.com`)\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "app.yaml"), []byte("two:\n  rule: Host(`two.example.com`)\n"), 0600)
+
+	c, err := NewConfig([]string{"--rules-dir=" + dir})
+	assert.Nil(err)
+	assert.Contains(c.Rules, "one@app")
+	assert.NotContains(c.Rules, "two@app")
+	if assert.Len(c.RuleFileErrors(), 1) {
+		assert.Contains(c.RuleFileErrors()[0].Error(), "would collide")
+	}
+}
+
+func TestRuleFilesParseIni(t *testing.T) {
+	assert := assert.New(t)
+
+	params, err := parseRuleIni([]byte("# comment\n[one]\naction = allow\nrule = \"Path(`/`)\"\n"))
+	assert.Nil(err)
+	assert.Equal(map[string]map[string]string{
+		"one": {"action": "allow", "rule": "Path(`/`)"},
+	}, params)
+
+	_, err = parseRuleIni([]byte("action = allow\n"))
+	if assert.NotNil(err) {
+		assert.Equal("line 1: param outside of a [<name>] section", err.Error())
+	}
+
+	_, err = parseRuleIni([]byte("[one]\naction\n"))
+	if assert.NotNil(err) {
+		assert.Equal("line 2: expected \"<param> = <value>\"", err.Error())
+	}
+
+	_, err = parseRuleIni([]byte("[]\n"))
+	if assert.NotNil(err) {
+		assert.Equal("line 1: route name is required", err.Error())
+	}
+}
+
+func TestRuleFilesParseYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	params, err := parseRuleYAML([]byte("one:\n  priority: 10\n  domains: [example.com, test.com]\n"))
+	assert.Nil(err)
+	assert.Equal(map[string]map[string]string{
+		"one": {"priority": "10", "domains": "example.com,test.com"},
+	}, params)
+
+	_, err = parseRuleYAML([]byte("one:\n  whitelist:\n    nested: true\n"))
+	if assert.NotNil(err) {
+		assert.Equal("invalid route param \"one.whitelist\", must be a value or list", err.Error())
+	}
+}
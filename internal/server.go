@@ -1,60 +1,217 @@
 package tfaps
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	muxhttp "github.com/traefik/traefik/v2/pkg/muxer/http"
 	"net/http"
 	"net/url"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Server contains muxer and handler methods
 type Server struct {
-	muxer *muxhttp.Muxer
+	muxer      *muxhttp.Muxer
+	plex       PlexClient
+	plexCache  *cachingPlexClient
+	sessions   SessionStore
+	tierChecks *tierCheckCache
+	logins     *loginLimiter
+
+	// Stops background tasks when the server is closed
+	stop     chan struct{}
+	stopOnce sync.Once
+	tasks    sync.WaitGroup
 }
 
 // NewServer creates a new server object and builds muxer
 func NewServer() *Server {
-	s := &Server{}
+	cfg := currentConfig()
+	return NewServerWithPlexClient(newCachingPlexClient(NewPlexClient(cfg), cfg.PlexCacheTTL))
+}
+
+// NewServerWithPlexClient creates a new server object that makes calls to
+// Plex with the given client, and builds muxer
+func NewServerWithPlexClient(plex PlexClient) *Server {
+	s := &Server{
+		plex:       plex,
+		tierChecks: newTierCheckCache(),
+		logins:     newLoginLimiter(),
+		stop:       make(chan struct{}),
+	}
+
+	cfg := currentConfig()
+	var err error
+	s.sessions, err = NewSessionStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s.sessions != nil {
+		s.every(10*time.Minute, s.cleanupSessions)
+	}
+	if cfg.RecheckInterval > 0 {
+		s.every(cfg.RecheckInterval, s.pruneTierChecks)
+	}
+	s.every(time.Minute, s.pruneLogins)
+	if cache, ok := plex.(*cachingPlexClient); ok {
+		s.plexCache = cache
+		if cache.ttl > 0 {
+			s.every(cache.ttl, s.prunePlexCache)
+		}
+	}
+
+	jwtKeys, err := LoadJWTKeys(cfg.JWTKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	configMu.Lock()
+	cfg.jwtKeys = jwtKeys
+	configMu.Unlock()
+
 	s.buildRoutes()
 	return s
 }
 
+// Close stops the server's background tasks, waiting for any that are running
+// to finish
+func (s *Server) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.tasks.Wait()
+}
+
+// Run a background task at the given interval until the server is closed
+func (s *Server) every(interval time.Duration, task func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				task()
+			}
+		}
+	}()
+}
+
 func (s *Server) buildRoutes() {
-	var err error
-	s.muxer, err = muxhttp.NewMuxer()
+	c := currentConfig()
+	muxer, err := s.newMuxer(c, s.ruleHandler, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Let's build a muxer
-	for name, rule := range config.Rules {
-		matchRule := rule.formattedRule()
-		if rule.Action == "allow" {
-			_ = s.muxer.AddRoute(matchRule, 1, s.AllowHandler(name))
-		} else {
-			_ = s.muxer.AddRoute(matchRule, 1, s.AuthHandler(name))
+	configMu.Lock()
+	s.muxer = muxer
+	configMu.Unlock()
+
+	logRules(c)
+}
+
+// Log the rules in the order they are evaluated
+func logRules(c *Config) {
+	for i, name := range c.OrderedRules() {
+		rule := c.Rules[name]
+		log.WithFields(logrus.Fields{
+			"order":    i + 1,
+			"name":     name,
+			"priority": rule.EffectivePriority(),
+			"action":   rule.Action,
+			"rule":     rule.Rule,
+		}).Info("Loaded rule")
+	}
+	log.WithField("action", c.DefaultAction).Info("Loaded default rule")
+}
+
+// Build a muxer for the given config, routing requests to the handler for the
+// rule they match, or to one of our own endpoints. The endpoint wrapper is
+// optional
+func (s *Server) newMuxer(c *Config, ruleHandler func(c *Config, name, action string) http.Handler, endpoint func(name string, h http.Handler) http.Handler) (*muxhttp.Muxer, error) {
+	muxer, err := muxhttp.NewMuxer()
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == nil {
+		endpoint = func(name string, h http.Handler) http.Handler {
+			return h
 		}
 	}
 
-	// Add callback handler
-	s.muxer.Handle(config.Path, s.AuthCallbackHandler())
+	// Add callback handler. Routes are matched in the order they are added,
+	// so our own endpoints come first, or a rule matching the host would
+	// take them over
+	muxer.Handle(c.Path, endpoint("callback", s.AuthCallbackHandler(c)))
+
+	// Add login handler
+	muxer.Handle(c.Path+"/login", endpoint("login", s.LoginHandler(c)))
 
 	// Add logout handler
-	s.muxer.Handle(config.Path+"/logout", s.LogoutHandler())
+	muxer.Handle(c.Path+"/logout", endpoint("logout", s.LogoutHandler(c)))
+
+	// Add JWKS handler
+	if len(c.JWTKeys) > 0 {
+		muxer.Handle(c.Path+"/.well-known/jwks.json", endpoint("jwks", s.JWKSHandler(c)))
+	}
+
+	// Add session admin handlers, the store is only created on startup
+	if s.sessions != nil {
+		muxer.Handle(c.Path+"/sessions", endpoint("sessions", s.SessionsHandler(c)))
+		muxer.Handle(c.Path+"/sessions/revoke", endpoint("revoke", s.RevokeHandler(c)))
+	}
+
+	// Add plex cache stats handler
+	if len(c.SessionAdmins) > 0 {
+		muxer.Handle(c.Path+"/plex-cache", endpoint("plex-cache", s.PlexCacheHandler(c)))
+	}
+
+	// Add rules
+	for _, name := range c.OrderedRules() {
+		rule := c.Rules[name]
+		err = muxer.AddRoute(rule.formattedRule(), rule.EffectivePriority(), ruleHandler(c, name, rule.Action))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule \"%s\": %v", name, err)
+		}
+	}
 
 	// Add a default handler
-	if config.DefaultAction == "allow" {
-		s.muxer.NewRoute().Handler(s.AllowHandler("default"))
-	} else {
-		s.muxer.NewRoute().Handler(s.AuthHandler("default"))
+	muxer.NewRoute().Handler(ruleHandler(c, "default", c.DefaultAction))
+
+	return muxer, nil
+}
+
+// Get the handler for a rule action. Handlers use the config the muxer was
+// built from, so a reload can't change the config partway through a request
+func (s *Server) ruleHandler(c *Config, name, action string) http.Handler {
+	switch action {
+	case "allow":
+		return s.AllowHandler(name)
+	case "deny":
+		return s.DenyHandler(c, name)
 	}
+
+	return s.AuthHandler(c, name)
 }
 
 // RootHandler Overwrites the request method, host and URL with those from the
 // forwarded request so it's correctly routed by mux
 func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
 	// Modify request
-	r.Method = r.Header.Get("X-Forwarded-Method")
+	if method := r.Header.Get("X-Forwarded-Method"); method != "" {
+		r.Method = method
+	}
 	r.Host = r.Header.Get("X-Forwarded-Host")
 
 	// Read URI from header if we're acting as forward auth middleware
@@ -63,7 +220,10 @@ func (s *Server) RootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Pass to mux
-	s.muxer.ServeHTTP(w, r)
+	configMu.RLock()
+	muxer := s.muxer
+	configMu.RUnlock()
+	muxer.ServeHTTP(w, r)
 }
 
 // AllowHandler Allows requests
@@ -74,25 +234,73 @@ func (s *Server) AllowHandler(rule string) http.HandlerFunc {
 	}
 }
 
+// DenyHandler Denies requests
+func (s *Server) DenyHandler(cfg *Config, rule string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Deny", rule, "Denying request")
+		s.denyRequest(cfg, logger, w, r, rule, Claims{})
+	}
+}
+
 // AuthHandler Authenticates requests
-func (s *Server) AuthHandler(rule string) http.HandlerFunc {
+func (s *Server) AuthHandler(cfg *Config, rule string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Logging setup
 		logger := s.logger(r, "Auth", rule, "Authenticating request")
 
+		// Authenticate machine clients by API key, bearer tokens that aren't a
+		// key may be for the upstream app, so fall through to other auth
+		if key, fromHeader := requestAPIKey(cfg, r); len(cfg.APIKeys) > 0 && len(key) > 0 {
+			if name, apiKey, ok := FindAPIKey(cfg, key); ok {
+				s.authorizeAPIKey(cfg, logger.WithField("api_key", name), w, r, rule, apiKey)
+				return
+			}
+			if fromHeader {
+				logger.Warn("Invalid api key")
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+			logger.Debug("Bearer token is not an api key")
+		}
+
+		// Authenticate API clients by Plex token
+		if token := plexToken(r); cfg.TokenAuth && len(token) > 0 {
+			claims, valid, err := s.tokenClaims(r.Context(), cfg, logger, token)
+			if err != nil {
+				logger.WithField("error", err).Error("Error validating plex token")
+				http.Error(w, "Service unavailable", 503)
+				return
+			}
+			if !valid {
+				logger.Warn("Invalid plex token")
+				http.Error(w, "Not authorized", 401)
+				return
+			}
+
+			if !s.authorizeUser(cfg, logger, rule, claims) {
+				s.denyRequest(cfg, logger, w, r, rule, claims)
+				return
+			}
+
+			logger.Debug("Allowing valid plex token request")
+			s.setIdentityHeaders(cfg, logger, w, r, rule, claims)
+			w.WriteHeader(200)
+			return
+		}
+
 		// Get auth cookie
-		c, err := r.Cookie(config.CookieName)
+		c, err := r.Cookie(cfg.CookieName)
 		if err != nil {
-			s.authRedirect(logger, w, r)
+			s.authRequired(cfg, logger, w, r)
 			return
 		}
 
 		// Validate cookie
-		email, err := ValidateCookie(r, c)
+		claims, err := s.validateCookie(cfg, r, c)
 		if err != nil {
-			if err.Error() == "Cookie has expired" {
-				logger.Info("Cookie has expired")
-				s.authRedirect(logger, w, r)
+			if err.Error() == "Cookie has expired" || err.Error() == "Session not found" {
+				logger.Info(err.Error())
+				s.authRequired(cfg, logger, w, r)
 			} else {
 				logger.WithField("error", err).Warn("Invalid cookie")
 				http.Error(w, "Not authorized", 401)
@@ -100,29 +308,158 @@ func (s *Server) AuthHandler(rule string) http.HandlerFunc {
 			return
 		}
 
-		// Validate user
-		valid := ValidateEmail(email, rule)
-		if !valid {
-			logger.WithField("email", Sanitize(email)).Warn("Invalid email")
+		// Re-verify access tier
+		claims, err = s.recheckAccessTier(r.Context(), cfg, logger, c, claims)
+		switch err {
+		case nil:
+		case ErrAccessRevoked:
+			logger.WithField("email", Sanitize(claims.Email)).Warn("Access to server has been revoked")
+			s.revokeSession(logger, c)
+			http.SetCookie(w, ClearCookie(cfg, r))
 			http.Error(w, "Not authorized", 401)
 			return
+		case ErrRecheckNoToken:
+			logger.WithField("email", Sanitize(claims.Email)).Info("Session can't be re-verified")
+			s.authRequired(cfg, logger, w, r)
+			return
+		default:
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		// Cookie was issued without an access tier, so re-authenticate
+		if claims.Tier == NoAccess && !ValidateAccessTier(cfg, claims.Tier, rule) {
+			logger.WithField("email", Sanitize(claims.Email)).Info("Cookie has no access tier")
+			s.authRequired(cfg, logger, w, r)
+			return
+		}
+
+		// Validate user
+		if !s.authorizeUser(cfg, logger, rule, claims) {
+			s.denyRequest(cfg, logger, w, r, rule, claims)
+			return
 		}
 
 		// Valid request
 		logger.Debug("Allowing valid request")
-		w.Header().Set("X-Forwarded-User", email)
+		s.setIdentityHeaders(cfg, logger, w, r, rule, claims)
 		w.WriteHeader(200)
 	}
 }
 
+// Respond to a request authenticated by a valid API key
+func (s *Server) authorizeAPIKey(cfg *Config, logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string, apiKey *APIKey) {
+	if apiKey.Expired() {
+		logger.Warn("API key has expired")
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+	claims := apiKey.Claims(cfg)
+	if !apiKey.Allows(rule) {
+		logger.Warn("API key is not permitted for rule")
+		s.denyRequest(cfg, logger, w, r, rule, claims)
+		return
+	}
+
+	if !s.authorizeUser(cfg, logger, rule, claims) {
+		s.denyRequest(cfg, logger, w, r, rule, claims)
+		return
+	}
+
+	logger.Info("Allowing valid api key request")
+	s.setIdentityHeaders(cfg, logger, w, r, rule, claims)
+	w.WriteHeader(200)
+}
+
+// Check the user is permitted by the whitelist, domain and access tier for
+// the rule
+func (s *Server) authorizeUser(cfg *Config, logger *logrus.Entry, rule string, claims Claims) bool {
+	if !ValidateEmail(cfg, claims.Email, rule) {
+		logger.WithField("email", Sanitize(claims.Email)).Warn("Invalid email")
+		return false
+	}
+
+	if !ValidateAccessTier(cfg, claims.Tier, rule) {
+		logger.WithFields(logrus.Fields{
+			"email":         Sanitize(claims.Email),
+			"access_tier":   claims.Tier,
+			"required_tier": requiredAccessTier(cfg, rule),
+		}).Warn("Insufficient access tier")
+		return false
+	}
+
+	return true
+}
+
+// Respond to a request the rule doesn't permit, with the status, redirect or
+// template configured for the rule
+func (s *Server) denyRequest(cfg *Config, logger *logrus.Entry, w http.ResponseWriter, r *http.Request, rule string, claims Claims) {
+	status := 401
+	body := "Not authorized"
+	ruleConfig, ok := cfg.Rules[rule]
+	if !ok {
+		ruleConfig = &Rule{Action: cfg.DefaultAction}
+	}
+
+	if ruleConfig.Action == "deny" {
+		status = 403
+		body = "Forbidden"
+	}
+	if ruleConfig.Status > 0 {
+		status = ruleConfig.Status
+	}
+
+	if len(ruleConfig.Redirect) > 0 {
+		http.Redirect(w, r, ruleConfig.Redirect, http.StatusTemporaryRedirect)
+		return
+	}
+
+	if ruleConfig.template != nil {
+		data := DenyData{
+			Email:    claims.Email,
+			Username: claims.Username,
+			Rule:     rule,
+			Host:     r.Host,
+			URL:      returnUrl(r),
+			Status:   status,
+		}
+
+		var b bytes.Buffer
+		err := ruleConfig.template.Execute(&b, data)
+		if err != nil {
+			logger.WithField("error", err).Error("Error rendering rule template")
+			http.Error(w, body, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(b.Bytes())
+		return
+	}
+
+	http.Error(w, body, status)
+}
+
+// DenyData holds the details of a denied request, as available to rule
+// templates
+type DenyData struct {
+	Email    string
+	Username string
+	Rule     string
+	Host     string
+	URL      string
+	Status   int
+}
+
 // AuthCallbackHandler Handles auth callback request
-func (s *Server) AuthCallbackHandler() http.HandlerFunc {
+func (s *Server) AuthCallbackHandler(cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Logging setup
 		logger := s.logger(r, "AuthCallback", "default", "Handling callback")
 
 		// Check for CSRF cookie
-		c, err := FindCSRFCookie(r)
+		c, err := FindCSRFCookie(cfg, r)
 		if err != nil {
 			logger.Info("Missing csrf cookie")
 			http.Error(w, "Not authorized", 401)
@@ -130,7 +467,8 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		}
 
 		// Validate CSRF cookie against state
-		valid, pinId, redirect, err := ValidateCSRFCookie(c)
+		state := r.URL.Query().Get("state")
+		valid, pinId, redirect, err := ValidateCSRFCookie(cfg, c, state)
 		if !valid {
 			logger.WithFields(logrus.Fields{
 				"error":       err,
@@ -141,10 +479,21 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		}
 
 		// Clear CSRF cookie
-		http.SetCookie(w, ClearCSRFCookie(r, c))
+		http.SetCookie(w, ClearCSRFCookie(cfg, r, c))
+
+		// Validate redirect
+		redirectURL, err := ValidateRedirect(cfg, r, redirect)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error":    err,
+				"redirect": Sanitize(redirect),
+			}).Warn("Invalid redirect")
+			http.Error(w, "Not authorized", 401)
+			return
+		}
 
 		// Exchange code for token
-		token, err := GetToken(logger, pinId)
+		token, err := s.plex.GetToken(r.Context(), logger, pinId)
 		if err != nil {
 			logger.WithField("error", err).Error("Code exchange failed with provider")
 			http.Error(w, "Service unavailable", 503)
@@ -152,7 +501,7 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		}
 
 		// Get user
-		user, err := GetUser(logger, token)
+		user, err := s.plex.GetUser(r.Context(), logger, token)
 		if err != nil {
 			logger.WithField("error", err).Error("Error getting user")
 			http.Error(w, "Service unavailable", 503)
@@ -160,8 +509,9 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 		}
 
 		// Verify that the user is a member of the configured server
-		if len(config.ServerIdentifier) > 0 {
-			accessTier, err := GetAccessTier(logger, token)
+		accessTier := NoAccess
+		if len(cfg.ServerIdentifier) > 0 {
+			accessTier, err = s.plex.GetAccessTier(r.Context(), logger, token, cfg.ServerIdentifier)
 			if err != nil {
 				logger.WithField("error", err).WithField("user", user.Email).Error("Error getting access tier")
 				http.Error(w, "Service unavailable", 503)
@@ -176,62 +526,271 @@ func (s *Server) AuthCallbackHandler() http.HandlerFunc {
 			}
 		}
 
+		// Keep the token to re-verify the access tier, or revoke it later
+		claims := NewClaims(cfg, user, accessTier)
+		if cfg.RecheckInterval > 0 || cfg.RevokePlexToken {
+			claims.Token, err = SealToken(cfg, token)
+			if err != nil {
+				logger.WithField("error", err).Error("Error sealing token")
+				http.Error(w, "Service unavailable", 503)
+				return
+			}
+		}
+
 		// Generate cookie
-		http.SetCookie(w, MakeCookie(r, user.Email))
+		cookie, err := s.makeCookie(cfg, r, claims)
+		if err != nil {
+			logger.WithField("error", err).Error("Error creating auth cookie")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+		http.SetCookie(w, cookie)
 		logger.WithFields(logrus.Fields{
 			"redirect": Sanitize(redirect),
 			"user":     user.Email,
 		}).Info("Successfully generated auth cookie, redirecting user.")
 
 		// Redirect
-		http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
+		http.Redirect(w, r, redirectURL.String(), http.StatusTemporaryRedirect)
 	}
 }
 
 // LogoutHandler logs a user out
-func (s *Server) LogoutHandler() http.HandlerFunc {
+func (s *Server) LogoutHandler(cfg *Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Clear cookie
-		http.SetCookie(w, ClearCookie(r))
-
 		logger := s.logger(r, "Logout", "default", "Handling logout")
+
+		// Revoke session, and the plex token it holds
+		if c, err := r.Cookie(cfg.CookieName); err == nil {
+			claims, err := s.validateCookie(cfg, r, c)
+			s.revokeSession(logger, c)
+			if err == nil {
+				s.revokePlexToken(r.Context(), cfg, logger, claims)
+			}
+		}
+
+		// Clear cookie
+		http.SetCookie(w, ClearCookie(cfg, r))
 		logger.Info("Logged out user")
 
-		if config.LogoutRedirect != "" {
-			http.Redirect(w, r, config.LogoutRedirect, http.StatusTemporaryRedirect)
+		if cfg.LogoutRedirect != "" {
+			http.Redirect(w, r, cfg.LogoutRedirect, http.StatusTemporaryRedirect)
 		} else {
 			http.Error(w, "You have been logged out", 401)
 		}
 	}
 }
 
-func (s *Server) authRedirect(logger *logrus.Entry, w http.ResponseWriter, r *http.Request) {
-	// Error indicates no cookie, request pin
-	pin, err := GetPin(logger)
+// SessionsHandler lists unexpired sessions for session admins
+func (s *Server) SessionsHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Sessions", "default", "Listing sessions")
+		if !s.authorizeSessionAdmin(cfg, logger, w, r) {
+			return
+		}
+
+		sessions, err := s.sessions.List()
+		if err != nil {
+			logger.WithField("error", err).Error("Error listing sessions")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		type sessionInfo struct {
+			Session  string     `json:"session"`
+			UserID   int64      `json:"user_id,omitempty"`
+			Username string     `json:"username,omitempty"`
+			Email    string     `json:"email"`
+			Tier     AccessTier `json:"access_tier"`
+			IssuedAt time.Time  `json:"issued_at"`
+			Expires  time.Time  `json:"expires"`
+		}
+		list := []sessionInfo{}
+		for key, claims := range sessions {
+			list = append(list, sessionInfo{
+				Session:  key,
+				UserID:   claims.UserID,
+				Username: claims.Username,
+				Email:    claims.Email,
+				Tier:     claims.Tier,
+				IssuedAt: time.Unix(claims.IssuedAt, 0),
+				Expires:  time.Unix(claims.Expires, 0),
+			})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].IssuedAt.Before(list[j].IssuedAt)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// Rejects requests made by a browser on behalf of another site
+var crossOriginProtection = http.NewCrossOriginProtection()
+
+// RevokeHandler revokes a session, or all sessions for a user, for session
+// admins
+func (s *Server) RevokeHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger(r, "Revoke", "default", "Revoking sessions")
+		if !s.authorizeSessionAdmin(cfg, logger, w, r) {
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", 405)
+			return
+		}
+
+		// The auth cookie is sent with requests from other sites
+		if err := crossOriginProtection.Check(r); err != nil {
+			logger.WithField("error", err).Warn("Refusing cross origin request")
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		var revoked int
+		var err error
+		if key := r.FormValue("session"); key != "" {
+			_, err = s.sessions.Get(key)
+			if errors.Is(err, ErrSessionNotFound) {
+				http.Error(w, "Session not found", 404)
+				return
+			}
+			if err == nil {
+				err = s.sessions.Delete(key)
+			}
+			if err == nil {
+				revoked = 1
+			}
+		} else if user := r.FormValue("user"); user != "" {
+			revoked, err = RevokeUserSessions(s.sessions, user)
+		} else {
+			http.Error(w, "session or user is required", 400)
+			return
+		}
+
+		if err != nil {
+			logger.WithField("error", err).Error("Error revoking sessions")
+			http.Error(w, "Service unavailable", 503)
+			return
+		}
+
+		logger.WithFields(logrus.Fields{
+			"session": Sanitize(r.FormValue("session")),
+			"user":    Sanitize(r.FormValue("user")),
+			"revoked": revoked,
+		}).Info("Revoked sessions")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"revoked": revoked})
+	}
+}
+
+// Check the request is from a session admin, writing an error if not
+func (s *Server) authorizeSessionAdmin(cfg *Config, logger *logrus.Entry, w http.ResponseWriter, r *http.Request) bool {
+	c, err := r.Cookie(cfg.CookieName)
 	if err != nil {
-		logger.WithField("error", err).Error("Error retrieving pin")
-		http.Error(w, "Service unavailable", 503)
+		http.Error(w, "Not authorized", 401)
+		return false
+	}
+
+	claims, err := s.validateCookie(cfg, r, c)
+	if err != nil || !ValidateWhitelist(claims.Email, cfg.SessionAdmins) {
+		logger.WithField("email", Sanitize(claims.Email)).Warn("Session admin not authorized")
+		http.Error(w, "Not authorized", 401)
+		return false
+	}
+
+	return true
+}
+
+// Get the claims held by, or referenced by, the auth cookie
+func (s *Server) validateCookie(cfg *Config, r *http.Request, c *http.Cookie) (Claims, error) {
+	if s.sessions != nil {
+		return ValidateSessionCookie(s.sessions, c)
+	}
+
+	return ValidateCookie(cfg, r, c)
+}
+
+// Revoke the session referenced by the auth cookie, if using a session store
+func (s *Server) revokeSession(logger *logrus.Entry, c *http.Cookie) {
+	if s.sessions == nil {
 		return
 	}
 
-	// Set the CSRF cookie
-	csrf := MakeCSRFCookie(r, string(pin.Id), redirectBase(r))
-	http.SetCookie(w, csrf)
+	err := s.sessions.Delete(SessionKey(c.Value))
+	if err != nil {
+		logger.WithField("error", err).Error("Error revoking session")
+	}
+}
 
-	if !config.InsecureCookie && r.Header.Get("X-Forwarded-Proto") != "https" {
-		logger.Warn("You are using \"secure\" cookies for a request that was not " +
-			"received via https. You should either redirect to https or pass the " +
-			"\"insecure-cookie\" config option to permit cookies via http.")
+// Make an auth cookie, creating a session if a session store is configured
+func (s *Server) makeCookie(cfg *Config, r *http.Request, claims Claims) (*http.Cookie, error) {
+	if s.sessions == nil {
+		return MakeCookie(cfg, r, claims)
 	}
 
-	// Forward them on
-	loginURL := GetLoginURL(redirectUri(r), pin.Code)
-	http.Redirect(w, r, loginURL, http.StatusTemporaryRedirect)
+	id, err := NewSessionID()
+	if err != nil {
+		return nil, err
+	}
 
-	logger.WithFields(logrus.Fields{
-		"csrf_cookie": csrf,
-		"login_url":   loginURL,
-	}).Debug("Set CSRF cookie and redirected to provider login url")
+	err = s.sessions.Save(SessionKey(id), claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return MakeSessionCookie(cfg, r, id, claims), nil
+}
+
+// Remove expired sessions from the session store
+func (s *Server) cleanupSessions() {
+	expired, err := s.sessions.Cleanup()
+	if err != nil {
+		log.WithField("error", err).Error("Error cleaning up sessions")
+	}
+	for _, claims := range expired {
+		s.revokePlexToken(context.Background(), currentConfig(), log.WithField("user", claims.Email), claims)
+	}
+}
+
+// Remove this service from the user's authorized Plex devices, if enabled and
+// the user has no other sessions
+func (s *Server) revokePlexToken(ctx context.Context, cfg *Config, logger *logrus.Entry, claims Claims) {
+	if !cfg.RevokePlexToken || len(claims.Token) == 0 {
+		return
+	}
+
+	// Plex issues one device per user for this service, so revoking it would
+	// log the user out of their other sessions too
+	if s.sessions != nil {
+		active, err := hasUserSessions(s.sessions, claims.Email)
+		if err != nil {
+			logger.WithField("error", err).Error("Error checking for other sessions")
+			return
+		}
+		if active {
+			logger.Debug("User has other sessions, not revoking plex token")
+			return
+		}
+	}
+
+	token, err := OpenToken(cfg, claims.Token)
+	if err != nil {
+		logger.WithField("error", err).Error("Error opening token to revoke")
+		return
+	}
+
+	err = s.plex.RevokeToken(ctx, logger, token)
+	if err != nil {
+		logger.WithField("error", err).Error("Error revoking plex token")
+		return
+	}
+
+	logger.Debug("Revoked plex token")
 }
 
 func (s *Server) logger(r *http.Request, handler, rule, msg string) *logrus.Entry {
@@ -242,7 +801,7 @@ func (s *Server) logger(r *http.Request, handler, rule, msg string) *logrus.Entr
 		"method":    Sanitize(r.Header.Get("X-Forwarded-Method")),
 		"proto":     Sanitize(r.Header.Get("X-Forwarded-Proto")),
 		"host":      Sanitize(r.Header.Get("X-Forwarded-Host")),
-		"uri":       Sanitize(r.Header.Get("X-Forwarded-Uri")),
+		"uri":       Sanitize(redactPlexToken(r.Header.Get("X-Forwarded-Uri"))),
 		"source_ip": Sanitize(r.Header.Get("X-Forwarded-For")),
 	})
 
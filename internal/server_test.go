@@ -0,0 +1,370 @@
+package tfaps
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dbendit/traefik-forward-auth-plex-sso/internal/fakeplex"
+	"github.com/dbendit/traefik-forward-auth-plex-sso/internal/fakeplex/fakeplextest"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestServerRulePriority(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+
+	// Requests carry an invalid cookie, so auth rules reject them without
+	// contacting Plex
+	request := func(s *Server, uri string) int {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		r.Header.Set("Cookie", config.CookieName+"=invalid")
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w.Code
+	}
+
+	// Longer rule should win by default
+	setTestConfig([]string{
+		"--rule.all.action=auth",
+		"--rule.all.rule=Host(`app.example.com`)",
+		"--rule.public.action=allow",
+		"--rule.public.rule=Host(`app.example.com`) && PathPrefix(`/public`)",
+	})
+	s := NewServer()
+	t.Cleanup(s.Close)
+	for i := 0; i < 10; i++ {
+		assert.Equal(200, request(s, "/public"), "narrow allow rule should match first")
+	}
+	assert.Equal(401, request(s, "/private"))
+
+	// Explicit priority should win
+	setTestConfig([]string{
+		"--rule.all.action=auth",
+		"--rule.all.rule=Host(`app.example.com`)",
+		"--rule.all.priority=1000",
+		"--rule.public.action=allow",
+		"--rule.public.rule=Host(`app.example.com`) && PathPrefix(`/public`)",
+	})
+	s = NewServer()
+	t.Cleanup(s.Close)
+	assert.Equal(401, request(s, "/public"), "higher priority auth rule should match first")
+}
+
+func TestServerDenyRule(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+
+	tmpl := filepath.Join(t.TempDir(), "denied.html")
+	require.Nil(t, os.WriteFile(tmpl, []byte(`<p>Sorry {{.Username}}, {{.URL}} is for {{.Rule}} only</p>`), 0600))
+
+	setTestConfig([]string{
+		"--default-action=deny",
+		"--rule.admin.action=deny",
+		"--rule.admin.rule=PathPrefix(`/admin`)",
+		"--rule.private.rule=PathPrefix(`/private`)",
+		"--rule.private.whitelist=jane@example.com",
+		"--rule.private.status=404",
+		"--rule.owners.rule=PathPrefix(`/owners`)",
+		"--rule.owners.whitelist=jane@example.com",
+		"--rule.owners.redirect=https://example.com/denied",
+		"--rule.members.rule=PathPrefix(`/members`)",
+		"--rule.members.whitelist=jane@example.com",
+		"--rule.members.template=" + tmpl,
+		"--rule.staff.rule=PathPrefix(`/staff`)",
+		"--rule.staff.whitelist=jane@example.com",
+	})
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	request := func(uri string, claims *Claims) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		if claims != nil {
+			r.AddCookie(mustMakeCookie(t, r, *claims))
+		}
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w
+	}
+	jane := NewClaims(config, User{Username: "jane", Email: "jane@example.com"}, NoAccess)
+	bob := NewClaims(config, User{Username: "<bob>", Email: "bob@example.com"}, NoAccess)
+
+	// Should deny everyone
+	w := request("/admin", &jane)
+	assert.Equal(403, w.Code)
+	w = request("/other", nil)
+	assert.Equal(403, w.Code, "default deny action should deny")
+
+	// Should allow permitted user
+	w = request("/private", &jane)
+	assert.Equal(200, w.Code)
+
+	// Should use rule status
+	w = request("/private", &bob)
+	assert.Equal(404, w.Code)
+
+	// Should use rule redirect
+	w = request("/owners", &bob)
+	assert.Equal(307, w.Code)
+	assert.Equal("https://example.com/denied", w.Header().Get("Location"))
+
+	// Should use rule template
+	w = request("/members/page?a=b", &bob)
+	assert.Equal(401, w.Code)
+	assert.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal("<p>Sorry &lt;bob&gt;, https://app.example.com/members/page?a=b is for members only</p>", w.Body.String())
+
+	// Should default to not authorized
+	w = request("/staff", &bob)
+	assert.Equal(401, w.Code)
+	assert.Equal("Not authorized\n", w.Body.String())
+}
+
+func TestServerLoginFlow(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	log, _ = test.NewNullLogger()
+
+	fixture, err := fakeplex.LoadFixture("../test/fakeplex.yaml")
+	require.Nil(err)
+	plex := fakeplextest.Start(t, fixture)
+
+	err = setTestConfig([]string{
+		"--secret=verysecret",
+		"--plex-url=" + plex.URL,
+		"--plex-login-url=" + plex.LoginURL,
+		"--server-identifier=test-server",
+		"--revoke-plex-token",
+		"--plex-cache-ttl=0",
+		"--rule.admin.rule=PathPrefix(`/admin`)",
+		"--rule.admin.tier=owner",
+		"--response-header=X-Name: {{.Title}}",
+		"--response-header=X-Plex-Pass: {{.Plan}}",
+	})
+	require.Nil(err)
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	request := func(uri string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		r.Header.Set("Accept", "text/html")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w
+	}
+
+	// Log in as the user, returning the auth cookie
+	login := func(username, uri string) *httptest.ResponseRecorder {
+		// Should show sign in page
+		w := request(uri, nil)
+		require.Equal(401, w.Code)
+		href := regexp.MustCompile(`href="([^"]+)"`).FindStringSubmatch(w.Body.String())
+		require.Len(href, 2, "sign in page should link to login")
+		start, err := url.Parse(html.UnescapeString(href[1]))
+		require.Nil(err)
+
+		// Should only create pin once user clicks
+		w = request(start.RequestURI(), nil)
+		require.Equal(307, w.Code)
+		location := w.Header().Get("Location")
+		require.True(strings.HasPrefix(location, plex.LoginURL+"?"), "should redirect to fake plex login")
+		q, err := url.ParseQuery(strings.TrimPrefix(location, plex.LoginURL+"?"))
+		require.Nil(err)
+
+		// As the login page does
+		require.Nil(plex.Claim(q.Get("code"), username))
+
+		forward, err := url.Parse(q.Get("forwardUrl"))
+		require.Nil(err)
+		return request(forward.RequestURI(), w.Result().Cookies())
+	}
+
+	// Should log in member and return to original url
+	w := login("family", "/page?a=b")
+	require.Equal(307, w.Code)
+	assert.Equal("https://app.example.com/page?a=b", w.Header().Get("Location"))
+
+	cookies := w.Result().Cookies()
+	w = request("/page", cookies)
+	assert.Equal(200, w.Code)
+	assert.Equal("family@example.com", w.Header().Get("X-Forwarded-User"))
+
+	// Should apply tier from plex
+	w = request("/admin", cookies)
+	assert.Equal(401, w.Code)
+
+	w = login("owner", "/admin")
+	require.Equal(307, w.Code)
+	w = request("/admin", w.Result().Cookies())
+	assert.Equal(200, w.Code)
+
+	// Should pass on the full user record
+	assert.Equal("The Owner", w.Header().Get("X-Name"))
+	assert.Equal("lifetime", w.Header().Get("X-Plex-Pass"))
+
+	// Should refuse user that isn't a member of the server
+	w = login("stranger", "/page")
+	assert.Equal(403, w.Code)
+
+	// Should remove this service from the user's devices on logout
+	logger := logrus.NewEntry(log)
+	_, err = s.plex.GetUser(context.Background(), logger, "family-token")
+	require.Nil(err)
+	w = request("/_oauth/logout", cookies)
+	assert.Equal(401, w.Code)
+	_, err = s.plex.GetUser(context.Background(), logger, "family-token")
+	assert.ErrorIs(err, ErrPlexUnauthorized, "token should be revoked")
+
+	// Should be able to log in again
+	w = login("family", "/page")
+	require.Equal(307, w.Code)
+	_, err = s.plex.GetUser(context.Background(), logger, "family-token")
+	assert.Nil(err)
+}
+
+func TestServerRevokePlexTokenWithSessions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+
+	fixture, err := fakeplex.LoadFixture("../test/fakeplex.yaml")
+	require.Nil(err)
+	plex := fakeplextest.Start(t, fixture)
+
+	err = setTestConfig([]string{
+		"--secret=verysecret",
+		"--plex-url=" + plex.URL,
+		"--plex-login-url=" + plex.LoginURL,
+		"--plex-cache-ttl=0",
+		"--session-store=memory",
+		"--revoke-plex-token",
+	})
+	require.Nil(err)
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	// Log in from two browsers, which share this service's Plex device
+	pin, err := s.plex.GetPin(context.Background(), logger)
+	require.Nil(err)
+	require.Nil(plex.Claim(pin.Code, "family"))
+	sealed, err := SealToken(config, "family-token")
+	require.Nil(err)
+	claims := NewClaims(config, User{Email: "family@example.com"}, NoAccess)
+	claims.Token = sealed
+
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	first, err := s.makeCookie(config, r, claims)
+	require.Nil(err)
+	second, err := s.makeCookie(config, r, claims)
+	require.Nil(err)
+
+	logout := func(c *http.Cookie) {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", "/_oauth/logout")
+		r.AddCookie(c)
+		s.RootHandler(httptest.NewRecorder(), r)
+	}
+
+	// Should not revoke the token while another session uses it
+	logout(first)
+	_, err = s.plex.GetUser(context.Background(), logger, "family-token")
+	assert.Nil(err, "token should not be revoked")
+
+	// Should revoke the token with the last session
+	logout(second)
+	_, err = s.plex.GetUser(context.Background(), logger, "family-token")
+	assert.ErrorIs(err, ErrPlexUnauthorized, "token should be revoked")
+}
+
+func TestServerEndpointsBeforeRules(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{
+		"--secret=verysecret",
+		"--rule.app.action=auth",
+		"--rule.app.rule=Host(`app.example.com`)",
+	})
+	plex := &pinPlexClient{}
+	s := NewServerWithPlexClient(plex)
+	t.Cleanup(s.Close)
+
+	request := func(uri string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		r.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w
+	}
+
+	// Should follow the sign in link to login, rather than the rule
+	w := request("/page")
+	assert.Equal(401, w.Code)
+	href := regexp.MustCompile(`href="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if assert.Len(href, 2, "sign in page should link to login") {
+		start, err := url.Parse(html.UnescapeString(href[1]))
+		assert.Nil(err)
+		w = request(start.RequestURI())
+		assert.Equal(307, w.Code)
+		assert.Equal(1, plex.pins)
+	}
+
+	// Should logout, rather than the rule
+	w = request("/_oauth/logout")
+	assert.Equal("You have been logged out\n", w.Body.String())
+}
+
+func TestServerClose(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{})
+	s := NewServer()
+
+	var runs atomic.Int32
+	s.every(time.Millisecond, func() {
+		runs.Add(1)
+	})
+	assert.Eventually(func() bool {
+		return runs.Load() > 0
+	}, time.Second, time.Millisecond)
+
+	// Should stop background tasks
+	s.Close()
+	stopped := runs.Load()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(stopped, runs.Load())
+
+	// Should be safe to close again
+	s.Close()
+}
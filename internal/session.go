@@ -0,0 +1,360 @@
+package tfaps
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session does not exist, has expired
+// or has been revoked
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore persists sessions server side so they can be revoked. Sessions
+// are keyed by a hash of the session id, so the store never holds the value
+// that is sent in the auth cookie
+type SessionStore interface {
+	// Get returns the claims for an unexpired session, or ErrSessionNotFound
+	Get(key string) (Claims, error)
+	// Save creates or replaces a session
+	Save(key string, claims Claims) error
+	// Delete revokes a session
+	Delete(key string) error
+	// List returns all unexpired sessions
+	List() (map[string]Claims, error)
+	// Cleanup removes all expired sessions, returning their claims
+	Cleanup() ([]Claims, error)
+}
+
+// NewSessionStore creates the session store selected by the "session-store"
+// config parameter, or nil if sessions are stateless
+func NewSessionStore(c *Config) (SessionStore, error) {
+	switch c.SessionStore {
+	case "memory":
+		return NewMemorySessionStore(), nil
+	case "file":
+		return NewFileSessionStore(c.SessionStorePath)
+	}
+
+	return nil, nil
+}
+
+// NewSessionID generates a random session id
+func NewSessionID() (string, error) {
+	id := make([]byte, 32)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// SessionKey returns the key a session id is stored under
+func SessionKey(id string) string {
+	hash := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(hash[:])
+}
+
+// RevokeUserSessions deletes all sessions belonging to the given email
+func RevokeUserSessions(store SessionStore, email string) (int, error) {
+	sessions, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for key, claims := range sessions {
+		if claims.Email == email {
+			err = store.Delete(key)
+			if err != nil {
+				return revoked, err
+			}
+			revoked++
+		}
+	}
+
+	return revoked, nil
+}
+
+// Whether the user has any unexpired sessions
+func hasUserSessions(store SessionStore, email string) (bool, error) {
+	sessions, err := store.List()
+	if err != nil {
+		return false, err
+	}
+
+	for _, claims := range sessions {
+		if claims.Email == email {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func sessionExpired(claims Claims) bool {
+	return time.Unix(claims.Expires, 0).Before(time.Now())
+}
+
+// Memory store
+
+// MemorySessionStore keeps sessions in memory, they are lost on restart
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Claims
+}
+
+// NewMemorySessionStore creates an empty in-memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]Claims{},
+	}
+}
+
+// Get returns the claims for an unexpired session
+func (m *MemorySessionStore) Get(key string) (Claims, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	claims, ok := m.sessions[key]
+	if !ok || sessionExpired(claims) {
+		return Claims{}, ErrSessionNotFound
+	}
+
+	return claims, nil
+}
+
+// Save creates or replaces a session
+func (m *MemorySessionStore) Save(key string, claims Claims) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[key] = claims
+	return nil
+}
+
+// Delete revokes a session
+func (m *MemorySessionStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, key)
+	return nil
+}
+
+// List returns all unexpired sessions
+func (m *MemorySessionStore) List() (map[string]Claims, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := map[string]Claims{}
+	for key, claims := range m.sessions {
+		if !sessionExpired(claims) {
+			sessions[key] = claims
+		}
+	}
+
+	return sessions, nil
+}
+
+// Cleanup removes all expired sessions, returning their claims
+func (m *MemorySessionStore) Cleanup() ([]Claims, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []Claims
+	for key, claims := range m.sessions {
+		if sessionExpired(claims) {
+			delete(m.sessions, key)
+			expired = append(expired, claims)
+		}
+	}
+
+	return expired, nil
+}
+
+// File store
+
+// FileSessionStore keeps each session in a file within a directory, so
+// sessions survive restarts and can be shared by instances on the same host
+type FileSessionStore struct {
+	dir string
+}
+
+// NewFileSessionStore creates a file session store, creating the directory if
+// required
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if len(dir) == 0 {
+		return nil, errors.New("session store path is required")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create session store directory: %w", err)
+	}
+
+	return &FileSessionStore{dir: dir}, nil
+}
+
+func (f *FileSessionStore) path(key string) (string, error) {
+	// Keys are hex encoded hashes, reject anything else to avoid path traversal
+	if _, err := hex.DecodeString(key); err != nil || len(key) == 0 {
+		return "", errors.New("invalid session key")
+	}
+
+	return filepath.Join(f.dir, key+".json"), nil
+}
+
+func (f *FileSessionStore) read(path string) (Claims, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Claims{}, ErrSessionNotFound
+		}
+		return Claims{}, err
+	}
+
+	var claims Claims
+	err = json.Unmarshal(b, &claims)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return claims, nil
+}
+
+// Get returns the claims for an unexpired session
+func (f *FileSessionStore) Get(key string) (Claims, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return Claims{}, ErrSessionNotFound
+	}
+
+	claims, err := f.read(path)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	if sessionExpired(claims) {
+		return Claims{}, ErrSessionNotFound
+	}
+
+	return claims, nil
+}
+
+// Save creates or replaces a session
+func (f *FileSessionStore) Save(key string, claims Claims) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename, so readers never see a partial file
+	tmp, err := os.CreateTemp(f.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete revokes a session
+func (f *FileSessionStore) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (f *FileSessionStore) each(fn func(key string, path string, claims Claims) error) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		path := filepath.Join(f.dir, name)
+		claims, err := f.read(path)
+		if err != nil {
+			// Removed since listing the directory, or unreadable
+			continue
+		}
+
+		err = fn(strings.TrimSuffix(name, ".json"), path, claims)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns all unexpired sessions
+func (f *FileSessionStore) List() (map[string]Claims, error) {
+	sessions := map[string]Claims{}
+	err := f.each(func(key string, path string, claims Claims) error {
+		if !sessionExpired(claims) {
+			sessions[key] = claims
+		}
+		return nil
+	})
+
+	return sessions, err
+}
+
+// Cleanup removes all expired sessions, returning their claims
+func (f *FileSessionStore) Cleanup() ([]Claims, error) {
+	var expired []Claims
+	err := f.each(func(key string, path string, claims Claims) error {
+		if sessionExpired(claims) {
+			err := os.Remove(path)
+			if errors.Is(err, os.ErrNotExist) {
+				// Another instance got there first
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			expired = append(expired, claims)
+		}
+		return nil
+	})
+
+	return expired, err
+}
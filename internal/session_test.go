@@ -0,0 +1,228 @@
+package tfaps
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestSessionMemoryStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore())
+}
+
+func TestSessionFileStore(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir())
+	require.Nil(t, err)
+	testSessionStore(t, store)
+
+	// Should reject keys that aren't hashes
+	_, err = store.Get("../../etc/passwd")
+	assert.Equal(t, ErrSessionNotFound, err)
+	assert.Error(t, store.Save("../session", Claims{}))
+
+	// Should require a path
+	_, err = NewFileSessionStore("")
+	assert.Error(t, err)
+}
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	assert := assert.New(t)
+	valid := Claims{Email: "test@test.com", Expires: time.Now().Add(time.Hour).Unix()}
+	expired := Claims{Email: "test@test.com", Expires: time.Now().Add(-time.Hour).Unix()}
+	other := Claims{Email: "other@test.com", Expires: time.Now().Add(time.Hour).Unix()}
+
+	// Should not find missing session
+	_, err := store.Get(SessionKey("missing"))
+	assert.Equal(ErrSessionNotFound, err)
+
+	// Should find saved session
+	assert.Nil(store.Save(SessionKey("one"), valid))
+	claims, err := store.Get(SessionKey("one"))
+	assert.Nil(err)
+	assert.Equal(valid, claims)
+
+	// Should not find expired session
+	assert.Nil(store.Save(SessionKey("two"), expired))
+	_, err = store.Get(SessionKey("two"))
+	assert.Equal(ErrSessionNotFound, err)
+
+	// Should list unexpired sessions
+	assert.Nil(store.Save(SessionKey("three"), other))
+	sessions, err := store.List()
+	assert.Nil(err)
+	assert.Equal(map[string]Claims{
+		SessionKey("one"):   valid,
+		SessionKey("three"): other,
+	}, sessions)
+
+	// Should remove expired sessions
+	removed, err := store.Cleanup()
+	assert.Nil(err)
+	assert.Equal([]Claims{expired}, removed)
+	assert.Nil(store.Save(SessionKey("two"), valid))
+	claims, err = store.Get(SessionKey("two"))
+	assert.Nil(err, "expired session should be replaceable after cleanup")
+	assert.Equal(valid, claims)
+
+	// Should delete session
+	assert.Nil(store.Delete(SessionKey("two")))
+	_, err = store.Get(SessionKey("two"))
+	assert.Equal(ErrSessionNotFound, err)
+	assert.Nil(store.Delete(SessionKey("two")), "deleting a missing session should not error")
+
+	// Should revoke all sessions for user
+	revoked, err := RevokeUserSessions(store, "test@test.com")
+	assert.Nil(err)
+	assert.Equal(1, revoked)
+	_, err = store.Get(SessionKey("one"))
+	assert.Equal(ErrSessionNotFound, err)
+	_, err = store.Get(SessionKey("three"))
+	assert.Nil(err, "other users sessions should not be revoked")
+}
+
+func TestSessionID(t *testing.T) {
+	assert := assert.New(t)
+
+	id1, err := NewSessionID()
+	assert.Nil(err)
+	id2, err := NewSessionID()
+	assert.Nil(err)
+	assert.NotEqual(id1, id2, "session ids should not be equal")
+
+	assert.Len(SessionKey(id1), 64)
+	assert.NotContains(SessionKey(id1), id1, "session key should not contain session id")
+}
+
+func TestSessionServerFlow(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{
+		"--session-store=memory",
+		"--session-admin=admin@test.com",
+	})
+	s := NewServer()
+	t.Cleanup(s.Close)
+	r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+
+	// Should issue a cookie holding only a session id
+	c, err := s.makeCookie(config, r, NewClaims(config, User{Email: "test@test.com"}, Owner))
+	require.Nil(t, err)
+	assert.NotContains(c.Value, "v2.")
+	claims, err := s.validateCookie(config, r, c)
+	assert.Nil(err)
+	assert.Equal("test@test.com", claims.Email)
+	assert.Equal(Owner, claims.Tier)
+
+	// Should not accept stateless cookies
+	_, err = s.validateCookie(config, r, mustMakeCookie(t, r, NewClaims(config, User{Email: "test@test.com"}, Owner)))
+	if assert.Error(err) {
+		assert.Equal("Session not found", err.Error())
+	}
+
+	// Should only allow session admins to list sessions
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://app.example.com/_oauth/sessions", nil)
+	req.AddCookie(c)
+	s.RootHandler(w, req)
+	assert.Equal(401, w.Code)
+
+	admin, err := s.makeCookie(config, r, NewClaims(config, User{Email: "admin@test.com"}, Owner))
+	require.Nil(t, err)
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://app.example.com/_oauth/sessions", nil)
+	req.AddCookie(admin)
+	s.RootHandler(w, req)
+	assert.Equal(200, w.Code)
+	var list []map[string]interface{}
+	assert.Nil(json.NewDecoder(w.Body).Decode(&list))
+	assert.Len(list, 2)
+
+	// Should require POST to revoke
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://app.example.com/_oauth/sessions/revoke?user=test@test.com", nil)
+	req.AddCookie(admin)
+	s.RootHandler(w, req)
+	assert.Equal(405, w.Code)
+
+	revoke := func(form url.Values, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://app.example.com/_oauth/sessions/revoke", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-Host", "app.example.com")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		req.AddCookie(admin)
+		s.RootHandler(w, req)
+		return w
+	}
+
+	// Should not revoke sessions for other sites
+	form := url.Values{"user": {"test@test.com"}}
+	w = revoke(form, map[string]string{"Sec-Fetch-Site": "cross-site"})
+	assert.Equal(403, w.Code)
+	w = revoke(form, map[string]string{"Origin": "https://evil.com"})
+	assert.Equal(403, w.Code)
+
+	// Should not revoke unknown sessions
+	w = revoke(url.Values{"session": {"unknown"}}, nil)
+	assert.Equal(404, w.Code)
+
+	// Should revoke user sessions
+	w = revoke(form, map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(200, w.Code)
+	assert.JSONEq(`{"revoked":1}`, w.Body.String())
+	_, err = s.validateCookie(config, r, c)
+	if assert.Error(err) {
+		assert.Equal("Session not found", err.Error())
+	}
+
+	// Should revoke session on logout
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "http://app.example.com/_oauth/logout", nil)
+	req.AddCookie(admin)
+	s.RootHandler(w, req)
+	assert.Equal(401, w.Code)
+	_, err = s.validateCookie(config, r, admin)
+	if assert.Error(err) {
+		assert.Equal("Session not found", err.Error())
+	}
+
+	// Should clear cookie on logout
+	cookies := w.Result().Cookies()
+	if assert.Len(cookies, 1) {
+		assert.Equal(config.CookieName, cookies[0].Name)
+		assert.Equal("", cookies[0].Value)
+	}
+}
+
+func TestSessionStoreEnabledByReload(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{"--secret=verysecret", "--session-admin=admin@test.com"})
+	s := NewServer()
+	t.Cleanup(s.Close)
+
+	// The store is only created on startup, so the admin endpoints shouldn't
+	// be added
+	setTestConfig([]string{"--secret=verysecret", "--session-store=memory", "--session-admin=admin@test.com"})
+	s.buildRoutes()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set("X-Forwarded-Uri", "/_oauth/sessions")
+	req.AddCookie(mustMakeCookie(t, req, NewClaims(config, User{Email: "admin@test.com"}, Owner)))
+	assert.NotPanics(func() { s.RootHandler(w, req) })
+	assert.Equal("", w.Body.String(), "should be handled by the default rule")
+}
@@ -0,0 +1,121 @@
+package tfaps
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Files in the state dir
+const (
+	stateClientIdentifierFile = "client-identifier"
+	stateSecretFile           = "secret"
+)
+
+// Load the client identifier and secret from the state dir, if they aren't
+// set by options, generating and persisting them the first time so they stay
+// the same across restarts. Values that are generated without persist are
+// only used until the service next starts
+func (c *Config) loadState(persist bool) error {
+	var err error
+	if persist {
+		err = os.MkdirAll(c.StateDir, 0700)
+		if err != nil {
+			return fmt.Errorf("unable to create state dir: %v", err)
+		}
+	}
+
+	if len(c.ClientIdentifierString) == 0 {
+		c.ClientIdentifier, _, err = loadStateValue(c.StateDir, stateClientIdentifierFile, persist, func() (string, error) {
+			return uuid.New().String(), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.SecretString) == 0 {
+		secret, created, err := loadStateValue(c.StateDir, stateSecretFile, persist, func() (string, error) {
+			b := make([]byte, 32)
+			_, err := rand.Read(b)
+			return hex.EncodeToString(b), err
+		})
+		if err != nil {
+			return err
+		}
+		c.Secret = []byte(secret)
+		c.stateSecretCreated = created
+	}
+
+	return nil
+}
+
+// Warn that a secret has been generated, as it needs to be kept safe
+func (c *Config) logStateSecretCreated() {
+	if !c.stateSecretCreated {
+		return
+	}
+
+	log.WithField("path", filepath.Join(c.StateDir, stateSecretFile)).Warn(
+		"No \"secret\" option set, generated a secret and saved it in the state dir. " +
+			"Keep this file safe, anyone with it can forge logins. " +
+			"Set \"secret\" instead if you run more than one instance")
+}
+
+// Read a value from a file in the state dir, or generate and write it if the
+// file doesn't exist. Returns true if the value was written
+func loadStateValue(dir, name string, persist bool, generate func() (string, error)) (string, bool, error) {
+	path := filepath.Join(dir, name)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		value := strings.TrimSpace(string(b))
+		if len(value) == 0 {
+			return "", false, fmt.Errorf("state file %s is empty", path)
+		}
+		return value, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", false, fmt.Errorf("unable to read state file: %v", err)
+	}
+
+	value, err := generate()
+	if err != nil || !persist {
+		return value, false, err
+	}
+
+	// Write a temporary file and link it into place, so other instances
+	// sharing the dir never see a partly written file
+	f, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return "", false, fmt.Errorf("unable to write state file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(value + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("unable to write state file: %v", err)
+	}
+
+	// Another instance sharing the dir may have got there first
+	err = os.Link(f.Name(), path)
+	if errors.Is(err, os.ErrExist) {
+		return loadStateValue(dir, name, persist, generate)
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("unable to write state file: %v", err)
+	}
+
+	return value, true, nil
+}
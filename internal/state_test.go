@@ -0,0 +1,125 @@
+package tfaps
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/**
+ * Tests
+ */
+
+func TestStatePersisted(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(t.TempDir(), "state")
+
+	// Should generate the client identifier and secret on first start
+	c1, err := NewConfig([]string{"--state-dir=" + dir})
+	require.Nil(err)
+	assert.Len(c1.ClientIdentifier, 36)
+	assert.Len(c1.Secret, 64)
+	assert.True(c1.stateSecretCreated)
+
+	info, err := os.Stat(filepath.Join(dir, "secret"))
+	require.Nil(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm(), "secret should only be readable by us")
+
+	// Should reuse them after a restart
+	c2, err := NewConfig([]string{"--state-dir=" + dir})
+	require.Nil(err)
+	assert.Equal(c1.ClientIdentifier, c2.ClientIdentifier)
+	assert.Equal(c1.Secret, c2.Secret)
+	assert.False(c2.stateSecretCreated)
+
+	// Options should take precedence
+	c3, err := NewConfig([]string{
+		"--state-dir=" + dir,
+		"--client-identifier=configured",
+		"--secret=configured",
+	})
+	require.Nil(err)
+	assert.Equal("configured", c3.ClientIdentifier)
+	assert.Equal([]byte("configured"), c3.Secret)
+
+	// Without a state dir the client identifier should change
+	c4, err := NewConfig([]string{})
+	require.Nil(err)
+	assert.NotEqual(c1.ClientIdentifier, c4.ClientIdentifier)
+}
+
+func TestStateSecretWarning(t *testing.T) {
+	assert := assert.New(t)
+
+	var hook *test.Hook
+	log, hook = test.NewNullLogger()
+	log.ExitFunc = func(code int) {}
+
+	dir := t.TempDir()
+	c, _ := NewConfig([]string{"--state-dir=" + dir})
+	c.Validate()
+
+	logs := hook.AllEntries()
+	if assert.Len(logs, 1, "secret should be generated, not required") {
+		assert.Equal(logrus.WarnLevel, logs[0].Level)
+		assert.Contains(logs[0].Message, "generated a secret")
+	}
+
+	// Should only warn when generated
+	hook.Reset()
+	c, _ = NewConfig([]string{"--state-dir=" + dir})
+	c.Validate()
+	assert.Len(hook.AllEntries(), 0)
+}
+
+func TestStateEmptyFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "client-identifier"), []byte("\n"), 0600)
+
+	_, err := NewConfig([]string{"--state-dir=" + dir})
+	if assert.NotNil(err) {
+		assert.Equal("state file "+filepath.Join(dir, "client-identifier")+" is empty", err.Error())
+	}
+}
+
+func TestStateReadOnly(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(t.TempDir(), "state")
+	c, err := newConfig([]string{"--state-dir=" + dir}, false)
+	require.Nil(err)
+	assert.Len(c.ClientIdentifier, 36)
+	assert.Len(c.Secret, 64)
+	assert.False(c.stateSecretCreated)
+	_, err = os.Stat(dir)
+	assert.True(os.IsNotExist(err), "state dir should not be created")
+}
+
+func TestStateConcurrentCreate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Should use the value of an instance that wrote the file first
+	dir := t.TempDir()
+	value, created, err := loadStateValue(dir, "secret", true, func() (string, error) {
+		return "ours", os.WriteFile(filepath.Join(dir, "secret"), []byte("theirs\n"), 0600)
+	})
+	require.Nil(err)
+	assert.Equal("theirs", value)
+	assert.False(created)
+
+	// Should not leave temporary files behind
+	entries, err := os.ReadDir(dir)
+	require.Nil(err)
+	assert.Len(entries, 1)
+}
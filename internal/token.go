@@ -0,0 +1,65 @@
+package tfaps
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Name of the header and query parameter Plex clients pass their token in
+const plexTokenParam = "X-Plex-Token"
+
+// Get the Plex token passed by an API client, if any
+func plexToken(r *http.Request) string {
+	if token := r.Header.Get(plexTokenParam); len(token) > 0 {
+		return token
+	}
+
+	return r.URL.Query().Get(plexTokenParam)
+}
+
+// Remove any Plex token from a request uri, so it isn't logged
+func redactPlexToken(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	q := u.Query()
+	if !q.Has(plexTokenParam) {
+		return uri
+	}
+
+	q.Set(plexTokenParam, "redacted")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Get the claims for the user a Plex token belongs to. The result is false if
+// the token is invalid or the user isn't a member of the configured server.
+// Results are cached by the Plex client, see plex-cache-ttl
+func (s *Server) tokenClaims(ctx context.Context, cfg *Config, logger *logrus.Entry, token string) (Claims, bool, error) {
+	// Plex rejecting the token means it's invalid, rather than unverified
+	user, err := s.plex.GetUser(ctx, logger, token)
+	if errors.Is(err, ErrPlexUnauthorized) || (err == nil && len(user.Email) == 0) {
+		return Claims{}, false, nil
+	} else if err != nil {
+		return Claims{}, false, err
+	}
+
+	tier := NoAccess
+	if len(cfg.ServerIdentifier) > 0 {
+		tier, err = s.plex.GetAccessTier(ctx, logger, token, cfg.ServerIdentifier)
+		if err != nil {
+			return Claims{}, false, err
+		}
+		if tier == NoAccess {
+			return Claims{}, false, nil
+		}
+	}
+
+	return NewClaims(cfg, user, tier), true, nil
+}
@@ -0,0 +1,136 @@
+package tfaps
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+/**
+ * Tests
+ */
+
+func TestTokenPlexToken(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "http://app.example.com/metrics", nil)
+	assert.Equal("", plexToken(r))
+
+	r = httptest.NewRequest("GET", "http://app.example.com/metrics?X-Plex-Token=query", nil)
+	assert.Equal("query", plexToken(r))
+
+	r.Header.Set("X-Plex-Token", "header")
+	assert.Equal("header", plexToken(r), "header should take precedence")
+}
+
+func TestTokenRedactPlexToken(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("/metrics?a=b", redactPlexToken("/metrics?a=b"))
+	assert.Equal("/metrics?X-Plex-Token=redacted&a=b", redactPlexToken("/metrics?a=b&X-Plex-Token=secret"))
+}
+
+// Plex client returning fixed results, for the calls a test needs
+type stubPlexClient struct {
+	PlexClient
+	users   map[string]User
+	userErr error
+	calls   int
+}
+
+func (p *stubPlexClient) GetUser(ctx context.Context, logger *logrus.Entry, token string) (User, error) {
+	p.calls++
+	if p.userErr != nil {
+		return User{}, p.userErr
+	}
+	if user, ok := p.users[token]; ok {
+		return user, nil
+	}
+	return User{}, ErrPlexUnauthorized
+}
+
+func TestTokenAuthHandler(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	setTestConfig([]string{
+		"--token-auth",
+		"--whitelist=test@test.com",
+		"--rule.admin.rule=PathPrefix(`/admin`)",
+		"--rule.admin.tier=owner",
+	})
+	plex := &stubPlexClient{users: map[string]User{
+		"valid": {Email: "test@test.com"},
+		"other": {Email: "other@test.com"},
+	}}
+	s := NewServerWithPlexClient(newCachingPlexClient(plex, time.Minute))
+	t.Cleanup(s.Close)
+
+	request := func(uri, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.Header.Set("X-Forwarded-Method", "GET")
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		if len(token) > 0 {
+			r.Header.Set("X-Plex-Token", token)
+		}
+		w := httptest.NewRecorder()
+		s.RootHandler(w, r)
+		return w
+	}
+
+	// Should allow valid token
+	w := request("/api", "valid")
+	assert.Equal(200, w.Code)
+	assert.Equal("test@test.com", w.Header().Get("X-Forwarded-User"))
+
+	// Should allow valid token in query
+	w = request("/api?X-Plex-Token=valid", "")
+	assert.Equal(200, w.Code)
+
+	// Should not allow invalid token
+	w = request("/api", "invalid")
+	assert.Equal(401, w.Code)
+
+	// Should apply whitelist
+	w = request("/api", "other")
+	assert.Equal(401, w.Code)
+
+	// Should apply rule tier
+	w = request("/admin", "valid")
+	assert.Equal(401, w.Code)
+
+	// Should only call Plex once for each token
+	request("/api", "invalid")
+	assert.Equal(3, plex.calls)
+}
+
+func TestTokenClaims(t *testing.T) {
+	assert := assert.New(t)
+	log, _ = test.NewNullLogger()
+	logger := logrus.NewEntry(log)
+	setTestConfig([]string{"--token-auth"})
+	plex := &stubPlexClient{users: map[string]User{"valid": {Email: "test@test.com"}}}
+	s := NewServerWithPlexClient(plex)
+	t.Cleanup(s.Close)
+
+	// Should accept a token Plex knows
+	claims, valid, err := s.tokenClaims(context.Background(), config, logger, "valid")
+	assert.Nil(err)
+	assert.True(valid)
+	assert.Equal("test@test.com", claims.Email)
+
+	// Should reject a token Plex rejects
+	_, valid, err = s.tokenClaims(context.Background(), config, logger, "revoked")
+	assert.Nil(err)
+	assert.False(valid)
+
+	// Should fail if Plex can't verify the token
+	plex.userErr = &PlexStatusError{StatusCode: 503}
+	_, _, err = s.tokenClaims(context.Background(), config, logger, "valid")
+	assert.NotNil(err)
+}